@@ -0,0 +1,69 @@
+package az
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeliveryPolicy decides which webhook deliveries are run.
+type DeliveryPolicy struct {
+	// TTL is how long delivery IDs are remembered to skip redeliveries, 0 disables de-duplication.
+	TTL time.Duration
+	// MaxAge rejects deliveries of events that happened longer ago, 0 accepts events of any age.
+	// Payloads are not timestamped: only pushes, and actions that update an issue, pull request, review or comment
+	// are timed, other deliveries are accepted.
+	MaxAge time.Duration
+	// Senders ignores events caused by automation.
+	Senders SenderPolicy
+}
+
+// DefaultDeliveryPolicy remembers deliveries for as long as GitHub offers to redeliver them.
+var DefaultDeliveryPolicy = DeliveryPolicy{TTL: 72 * time.Hour}
+
+// Warnings describes deliveries the policy would run again.
+func (p DeliveryPolicy) Warnings() []string {
+	switch {
+	case p.TTL == 0:
+		return []string{"delivery de-duplication is disabled, redelivered events run the workflow again"}
+	case p.MaxAge == 0 || p.MaxAge > p.TTL:
+		return []string{fmt.Sprintf("signed payloads replayed after %s run the workflow again, set a max delivery age to reject them", p.TTL)}
+	}
+	return nil
+}
+
+var cleanupBindings = []byte(`{
+  "bindings": [
+    {
+      "type": "timerTrigger",
+      "direction": "in",
+      "name": "timer",
+      "schedule": "0 0 * * * *"
+    }
+  ]
+}`)
+
+// js is the policy, as read by the functions.
+func (p DeliveryPolicy) js() interface{} {
+	logins := p.Senders.Logins
+	if logins == nil {
+		logins = []string{}
+	}
+	return struct {
+		TTLSeconds    float64  `json:"ttlSeconds"`
+		MaxAgeSeconds float64  `json:"maxAgeSeconds"`
+		Logins        []string `json:"logins"`
+		Bots          bool     `json:"bots"`
+		AppID         int64    `json:"appId"`
+	}{
+		TTLSeconds:    p.TTL.Seconds(),
+		MaxAgeSeconds: p.MaxAge.Seconds(),
+		Logins:        logins,
+		Bots:          p.Senders.Bots,
+		AppID:         p.Senders.AppID,
+	}
+}
+
+// GenerateCleanup generates the timer function that prunes expired delivery records.
+func GenerateCleanup(policy DeliveryPolicy) (string, error) {
+	return render("cleanup.js.tmpl", struct{ Policy interface{} }{Policy: policy.js()})
+}
@@ -0,0 +1,16 @@
+package az_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thepwagner/func-soul-brother/az"
+)
+
+func TestDeliveryPolicy_Warnings(t *testing.T) {
+	assert.Len(t, az.DeliveryPolicy{}.Warnings(), 1)
+	assert.Len(t, az.DefaultDeliveryPolicy.Warnings(), 1)
+	assert.Len(t, az.DeliveryPolicy{TTL: time.Hour, MaxAge: 2 * time.Hour}.Warnings(), 1)
+	assert.Empty(t, az.DeliveryPolicy{TTL: time.Hour, MaxAge: time.Hour}.Warnings())
+}
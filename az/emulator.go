@@ -0,0 +1,221 @@
+package az
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+// Emulator serves a converted flow locally, running its functions with node instead of the Azure Functions host.
+// Each delivery runs to completion before it is responded to, so there is no queue between the functions.
+type Emulator struct {
+	// Sign replaces the signature of every delivery with one by the first secret, so recorded payloads can be posted
+	// as is. Anyone who can reach the emulator can then run the workflows.
+	Sign bool
+	// Output receives the functions' logs and the steps' output.
+	Output io.Writer
+	// Env is the environment of the functions, e.g. AzureWebJobsStorage for concurrency groups.
+	Env []string
+
+	node    string
+	dir     string
+	secrets []string
+}
+
+// hostRequest and hostResponse are exchanged with host.js.
+type hostRequest struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type hostResponse struct {
+	Status int
+	Body   interface{}
+	Logs   []string
+}
+
+// NewEmulator packages the flow with the app files in root, as it would be deployed.
+func NewEmulator(root string, flow flows.LoadedFlow, secrets []string, token string, policy DeliveryPolicy) (*Emulator, error) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		return nil, fmt.Errorf("finding node: %w", err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("webhook secret is required")
+	}
+
+	// Nothing enforces the function timeout locally:
+	hostJSON, _, err := HostJSON(flow, PremiumPlan)
+	if err != nil {
+		return nil, err
+	}
+	codeZip, err := packageFunctionZip(root, secrets, token, flow, policy, hostJSON)
+	if err != nil {
+		return nil, fmt.Errorf("packaging functions: %w", err)
+	}
+	dir, err := ioutil.TempDir("", "fsb-run")
+	if err != nil {
+		return nil, err
+	}
+	e := &Emulator{
+		Output:  os.Stderr,
+		Env:     os.Environ(),
+		node:    node,
+		dir:     dir,
+		secrets: secrets,
+	}
+	if err := unzipTo(codeZip, e.appDir()); err != nil {
+		_ = e.Close()
+		return nil, fmt.Errorf("extracting functions: %w", err)
+	}
+	hostJS, err := includeJS("host.js")
+	if err != nil {
+		_ = e.Close()
+		return nil, err
+	}
+	if err := ioutil.WriteFile(e.hostPath(), []byte(hostJS), 0644); err != nil {
+		_ = e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Emulator) appDir() string   { return filepath.Join(e.dir, "app") }
+func (e *Emulator) hostPath() string { return filepath.Join(e.dir, "host.js") }
+
+// Close removes the extracted functions.
+func (e *Emulator) Close() error {
+	return os.RemoveAll(e.dir)
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a webhook delivery", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := hostRequest{Headers: make(map[string]string, len(r.Header)), Body: string(body)}
+	for k := range r.Header {
+		req.Headers[strings.ToLower(k)] = r.Header.Get(k)
+	}
+	if e.Sign {
+		req.Headers["x-hub-signature-256"] = signPayload(e.secrets[0], body)
+	}
+
+	logger := logrus.WithField("event", req.Headers["x-github-event"])
+	logger.Info("Running delivery")
+	responses, err := e.run(r.Context(), []hostRequest{req})
+	if err != nil {
+		logger.WithError(err).Error("Running delivery")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res := responses[0]
+	logger.WithField("status", res.Status).Info("Ran delivery")
+
+	if s, ok := res.Body.(string); ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(res.Status)
+		_, _ = io.WriteString(w, s+"\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status)
+	_ = json.NewEncoder(w).Encode(res.Body)
+}
+
+// run sends requests to the functions through host.js.
+func (e *Emulator) run(ctx context.Context, requests []hostRequest) ([]hostResponse, error) {
+	tmp, err := ioutil.TempDir(e.dir, "delivery")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	requestsJSON, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+	requestsPath := filepath.Join(tmp, "requests.json")
+	if err := ioutil.WriteFile(requestsPath, requestsJSON, 0644); err != nil {
+		return nil, err
+	}
+	responsesPath := filepath.Join(tmp, "responses.json")
+
+	cmd := exec.CommandContext(ctx, e.node, e.hostPath(), e.appDir(), requestsPath, responsesPath)
+	cmd.Env = e.Env
+	cmd.Stdout = e.Output
+	cmd.Stderr = e.Output
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running node: %w", err)
+	}
+
+	responsesJSON, err := ioutil.ReadFile(responsesPath)
+	if err != nil {
+		return nil, err
+	}
+	var responses []hostResponse
+	if err := json.Unmarshal(responsesJSON, &responses); err != nil {
+		return nil, fmt.Errorf("parsing responses: %w", err)
+	}
+	return responses, nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func unzipTo(b []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		fn := filepath.Join(dir, filepath.FromSlash(zf.Name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(zf, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(zf *zip.File, fn string) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,97 @@
+package az_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/az"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestEmulator(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not installed")
+	}
+	action, err := ioutil.ReadFile("testdata/action.js")
+	require.NoError(t, err)
+	flow := flows.LoadedFlow{
+		Name:     "cloud.yml",
+		Triggers: []flows.Trigger{{Event: "issue_comment", Actions: []string{"created"}}},
+		Jobs: []flows.LoadedJob{{
+			Name: "echo-timer",
+			Instances: []flows.JobInstance{{
+				Name: "echo-timer",
+				Steps: []flows.LoadedStep{{
+					Name:   "echo-timer-0",
+					Action: flows.ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"},
+					SHA:    "0123456789abcdef0123456789abcdef01234567",
+					Main:   "dist/index.js",
+					Files:  map[string][]byte{"dist/index.js": action},
+					Inputs: map[string]string{"id": "Cloud"},
+				}},
+			}},
+		}},
+	}
+	e, err := az.NewEmulator("..", flow, []string{"secret"}, "token", az.DeliveryPolicy{})
+	require.NoError(t, err)
+	defer e.Close()
+
+	dir, err := ioutil.TempDir("", "fsb-emulator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	actionLog := filepath.Join(dir, "actions.log")
+	e.Env = append(os.Environ(), "FSB_ACTION_LOG="+actionLog)
+	var output bytes.Buffer
+	e.Output = &output
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	payload, err := ioutil.ReadFile("testdata/webhooks/issue_comment.created.json")
+	require.NoError(t, err)
+	post := func(signature string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(payload))
+		require.NoError(t, err)
+		if signature != "" {
+			req.Header.Set("X-Hub-Signature-256", signature)
+		}
+		req.Header.Set("X-GitHub-Event", "issue_comment")
+		req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	// Recorded payloads are unsigned:
+	status, body := post("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "Signature failed", body)
+	_, err = os.Stat(actionLog)
+	assert.True(t, os.IsNotExist(err))
+
+	// Signing replaces signatures that do not verify:
+	e.Sign = true
+	status, body = post("sha256=0123")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.JSONEq(t, `{"id":"72d3162e-cc78-11e3-81ab-4c9367dc0958"}`, body)
+	assert.Contains(t, output.String(), "FuncSoulBrotherWorker: running delivery 72d3162e-cc78-11e3-81ab-4c9367dc0958, attempt 1\n")
+	runs, err := ioutil.ReadFile(actionLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(runs), `"INPUT_ID":"Cloud"`)
+
+	res, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
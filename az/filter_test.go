@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/func-soul-brother/az"
 	"github.com/thepwagner/func-soul-brother/flows"
 )
@@ -39,7 +40,8 @@ func TestGenerateFilterFunction(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			body := az.GenerateFilterFunction(tc.Triggers)
+			body, err := az.GenerateFilterFunction(tc.Triggers)
+			require.NoError(t, err)
 			t.Log(body)
 			assert.Contains(t, strings.Join(strings.Fields(body), ""),
 				strings.Join(strings.Fields(tc.Body), ""))
@@ -0,0 +1,141 @@
+package az
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxForwardedPayload is GitHub's limit on webhook payloads.
+const maxForwardedPayload = 25 * 1024 * 1024
+
+// Forward relays webhook deliveries from a smee.io style channel, which streams them as server-sent events, to target.
+// It reconnects until ctx is done.
+func Forward(ctx context.Context, client *http.Client, source, target string) error {
+	backoff := time.Second
+	for {
+		connected, err := forwardEvents(ctx, client, source, target)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			backoff = time.Second
+		}
+		logrus.WithError(err).WithField("retry", backoff).Warn("Forwarding disconnected")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// forwardEvents relays deliveries until the source disconnects.
+func forwardEvents(ctx context.Context, client *http.Client, source, target string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("connecting: %s", res.Status)
+	}
+	logrus.WithField("source", source).Info("Forwarding deliveries")
+
+	err = readEvents(res.Body, func(event string, data []byte) error {
+		if event != "" && event != "message" {
+			return nil
+		}
+		if err := forwardDelivery(ctx, client, target, data); err != nil {
+			logrus.WithError(err).Error("Forwarding delivery")
+		}
+		return nil
+	})
+	if err == nil {
+		err = io.EOF
+	}
+	return true, err
+}
+
+// forwardDelivery posts a delivery to target, with the body as smee sent it. smee re-encodes the JSON payload,
+// so the bytes may differ from what GitHub signed and X-Hub-Signature-256 can fail to verify.
+func forwardDelivery(ctx context.Context, client *http.Client, target string, data []byte) error {
+	var delivery map[string]json.RawMessage
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return fmt.Errorf("parsing delivery: %w", err)
+	}
+	body, ok := delivery["body"]
+	if !ok {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, raw := range delivery {
+		var v string
+		if k == "body" || json.Unmarshal(raw, &v) != nil {
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	logrus.WithFields(logrus.Fields{
+		"event":  req.Header.Get("X-GitHub-Event"),
+		"status": res.StatusCode,
+	}).Info("Forwarded delivery")
+	return nil
+}
+
+// readEvents parses server-sent events, calling fn with each event's type and data.
+func readEvents(r io.Reader, fn func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 2*maxForwardedPayload)
+	var event string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				if err := fn(event, data.Bytes()); err != nil {
+					return err
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
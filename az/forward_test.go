@@ -0,0 +1,61 @@
+package az_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/az"
+)
+
+func TestForward(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Like smee.io, deliveries are JSON with the headers and body:
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+		_, _ = fmt.Fprint(w, ": keepalive\n\n")
+		_, _ = fmt.Fprint(w, `data: {"x-github-event":"push","x-hub-signature-256":"sha256=abc","body":{"zen":"Avoid administrative distraction.","html":"<b>"},"query":{},"timestamp":1588428000000}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer source.Close()
+
+	type forwarded struct {
+		header http.Header
+		body   string
+	}
+	received := make(chan forwarded, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received <- forwarded{header: r.Header, body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- az.Forward(ctx, http.DefaultClient, source.URL, target.URL) }()
+
+	select {
+	case f := <-received:
+		assert.Equal(t, "push", f.header.Get("X-GitHub-Event"))
+		assert.Equal(t, "sha256=abc", f.header.Get("X-Hub-Signature-256"))
+		assert.Empty(t, f.header.Get("Timestamp"))
+		// The body is forwarded as smee sent it, not re-encoded again:
+		assert.Equal(t, `{"zen":"Avoid administrative distraction.","html":"<b>"}`, f.body)
+	case <-ctx.Done():
+		t.Fatal("delivery was not forwarded")
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -24,15 +25,18 @@ import (
 type FunctionUploader struct {
 	deploys           resources.DeploymentsClient
 	resourceGroupName string
-	webhookSecret     string
+	webhookSecrets    []string
 	githubToken       string
+	plan              Plan
+	deliveries        DeliveryPolicy
 	storage           storage.AccountsClient
 }
 
-func NewFunctionUploader(subscriptionID, resourceGroupName, webhookSecret, githubToken string) (*FunctionUploader, error) {
+func NewFunctionUploader(subscriptionID, resourceGroupName string, webhookSecrets []string, githubToken string, plan Plan, deliveries DeliveryPolicy) (*FunctionUploader, error) {
 	logrus.WithFields(logrus.Fields{
 		"subscription_id": subscriptionID,
 		"rg_name":         resourceGroupName,
+		"plan":            plan,
 	}).Debug("Initializing uploader")
 
 	// FIXME: real authorizer
@@ -56,8 +60,10 @@ func NewFunctionUploader(subscriptionID, resourceGroupName, webhookSecret, githu
 		deploys:           deploys,
 		resourceGroupName: resourceGroupName,
 		storage:           storageAccounts,
-		webhookSecret:     webhookSecret,
+		webhookSecrets:    webhookSecrets,
 		githubToken:       githubToken,
+		plan:              plan,
+		deliveries:        deliveries,
 	}, nil
 }
 
@@ -66,8 +72,18 @@ func (f *FunctionUploader) Upload(ctx context.Context, flow flows.LoadedFlow) er
 	deploymentName = strings.ReplaceAll(deploymentName, ".", "")
 	deploymentName = fmt.Sprintf("fsb%s", deploymentName)
 
+	hostJSON, warnings, err := HostJSON(flow, f.plan)
+	if err != nil {
+		return err
+	}
+	warnings = append(warnings, f.deliveries.Warnings()...)
+	warnings = append(warnings, f.deliveries.Senders.Warnings(flow)...)
+	for _, warning := range warnings {
+		logrus.WithField("workflow", flow.Name).Warn(warning)
+	}
+
 	// FIXME: the storage account may not exist on first deploy; break the template up to separate storage from the function
-	codeZip, err := packageFunctionZip(f.webhookSecret, f.githubToken, flow)
+	codeZip, err := packageFunctionZip(".", f.webhookSecrets, f.githubToken, flow, f.deliveries, hostJSON)
 	if err != nil {
 		return fmt.Errorf("generating code: %w", err)
 	}
@@ -98,6 +114,9 @@ func (f *FunctionUploader) deployFunction(ctx context.Context, deploymentName, w
 				"blobURL": map[string]interface{}{
 					"value": blobURL,
 				},
+				"planSku": map[string]interface{}{
+					"value": f.plan.SKU(),
+				},
 			},
 			Mode: resources.Incremental,
 		},
@@ -164,68 +183,113 @@ func (f *FunctionUploader) uploadCode(ctx context.Context, storageAccountName st
 	return signedURL, nil
 }
 
-func packageFunctionZip(secret, token string, flow flows.LoadedFlow) ([]byte, error) {
+// appFunction is a function of the generated app.
+type appFunction struct {
+	name     string
+	bindings []byte
+	index    string
+}
+
+// packageFunctionZip packages the flow's functions with the app files (package.json, node_modules...) in root.
+func packageFunctionZip(root string, secrets []string, token string, flow flows.LoadedFlow, policy DeliveryPolicy, hostJSON []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	zw := zip.NewWriter(&buf)
 
-	functionJSON, err := zw.Create("FuncSoulBrother/function.json")
+	entrypoint, err := GenerateEntrypoint(secrets, flow, policy)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := functionJSON.Write(functionBindings); err != nil {
+	worker, err := GenerateWorker(token, flow)
+	if err != nil {
 		return nil, err
 	}
-
-	indexJS, err := zw.Create("FuncSoulBrother/index.js")
+	poison, err := GeneratePoisonHandler()
 	if err != nil {
 		return nil, err
 	}
-	if _, err := indexJS.Write([]byte(GenerateEntrypoint(secret, token, flow))); err != nil {
-		return nil, err
+	functions := []appFunction{
+		{name: "FuncSoulBrother", bindings: functionBindings, index: entrypoint},
+		{name: "FuncSoulBrotherWorker", bindings: deliveryBindings, index: worker},
+		{name: "FuncSoulBrotherPoison", bindings: poisonBindings, index: poison},
+	}
+	if policy.TTL > 0 {
+		cleanup, err := GenerateCleanup(policy)
+		if err != nil {
+			return nil, err
+		}
+		functions = append(functions, appFunction{name: "FuncSoulBrotherCleanup", bindings: cleanupBindings, index: cleanup})
+	}
+	for _, fn := range functions {
+		functionJSON, err := zw.Create(path.Join(fn.name, "function.json"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := functionJSON.Write(fn.bindings); err != nil {
+			return nil, err
+		}
+		indexJS, err := zw.Create(path.Join(fn.name, "index.js"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := indexJS.Write([]byte(fn.index)); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := addFile(zw, "host.json"); err != nil {
+	host, err := zw.Create("host.json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := host.Write(hostJSON); err != nil {
 		return nil, err
 	}
 
-	if err := addFile(zw, "package.json"); err != nil {
+	if err := addFile(zw, root, "package.json"); err != nil {
 		return nil, err
 	}
-	if err := addFile(zw, "package-lock.json"); err != nil {
+	if err := addFile(zw, root, "package-lock.json"); err != nil {
 		return nil, err
 	}
-	modulesWalkErr := filepath.Walk("node_modules", func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	// Without dependencies, node_modules may not exist:
+	modulesWalkErr := filepath.Walk(filepath.Join(root, "node_modules"), func(fn string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
 			return err
 		}
 		if info.IsDir() {
 			return nil
 		}
-		return addFile(zw, path)
+		name, err := filepath.Rel(root, fn)
+		if err != nil {
+			return err
+		}
+		return addFile(zw, root, filepath.ToSlash(name))
 	})
 	if modulesWalkErr != nil {
 		return nil, modulesWalkErr
 	}
 
-	stepFiles := map[string]struct{}{}
-	for _, step := range flow.Steps {
-		fn := step.Filename()
-
-		if _, ok := stepFiles[fn]; ok {
+	actionDirs := map[string]struct{}{}
+	for _, step := range flow.Steps() {
+		dir := step.Dir()
+		if _, ok := actionDirs[dir]; ok {
 			continue
 		}
-		stepFiles[fn] = struct{}{}
+		actionDirs[dir] = struct{}{}
 
-		stepFile, err := zw.Create(fmt.Sprintf("%s.js", fn))
-		if err != nil {
-			return nil, err
-		}
-		if _, err := fmt.Fprint(stepFile, step.SourceCode); err != nil {
-			return nil, err
+		for fn, contents := range step.Files {
+			stepFile, err := zw.Create(path.Join(dir, fn))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := stepFile.Write(contents); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if err := addFile(zw, "proxies.json"); err != nil {
+	if err := addFile(zw, root, "proxies.json"); err != nil {
 		return nil, err
 	}
 
@@ -235,12 +299,14 @@ func packageFunctionZip(secret, token string, flow flows.LoadedFlow) ([]byte, er
 	return buf.Bytes(), nil
 }
 
-func addFile(zw *zip.Writer, path string) error {
-	f, err := os.Open(path)
+// addFile copies root's file to the same name in the zip.
+func addFile(zw *zip.Writer, root, name string) error {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
 	if err != nil {
 		return err
 	}
-	zf, err := zw.Create(path)
+	defer f.Close()
+	zf, err := zw.Create(name)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,473 @@
+package az
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+const (
+	harnessSecret = "s3cr3t"
+	harnessToken  = "t0k3n"
+)
+
+// harnessFlow runs the fake action for comments, like thepwagner/echo-chamber's cloud.yml.
+func harnessFlow(t *testing.T) flows.LoadedFlow {
+	action, err := ioutil.ReadFile("testdata/action.js")
+	require.NoError(t, err)
+	return flows.LoadedFlow{
+		Name:     "cloud.yml",
+		Triggers: []flows.Trigger{{Event: "issue_comment", Actions: []string{"created"}}},
+		Jobs: []flows.LoadedJob{{
+			Name: "echo-timer",
+			Instances: []flows.JobInstance{{
+				Name: "echo-timer",
+				Steps: []flows.LoadedStep{{
+					Name:   "echo-timer-0",
+					Action: flows.ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"},
+					SHA:    "0123456789abcdef0123456789abcdef01234567",
+					Main:   "dist/index.js",
+					Files:  map[string][]byte{"dist/index.js": action},
+					Inputs: map[string]string{"id": "Cloud", "token": "${{ github.token }}"},
+					Env:    map[string]string{"GREETING": "hello"},
+				}},
+			}},
+		}},
+	}
+}
+
+type actionRun struct {
+	Env   map[string]string
+	Event map[string]interface{}
+}
+
+// runPackage sends requests to the packaged app through the emulator, using storage if not nil.
+func runPackage(t *testing.T, flow flows.LoadedFlow, policy DeliveryPolicy, storage *fakeStorage, requests []hostRequest) ([]hostResponse, []actionRun) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not installed")
+	}
+	e, err := NewEmulator("..", flow, []string{harnessSecret}, harnessToken, policy)
+	require.NoError(t, err)
+	defer e.Close()
+
+	actionLog := filepath.Join(e.dir, "actions.log")
+	// Without storage, like a fresh checkout:
+	e.Env = nil
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "AzureWebJobsStorage=") {
+			e.Env = append(e.Env, kv)
+		}
+	}
+	e.Env = append(e.Env, "FSB_ACTION_LOG="+actionLog)
+	if storage != nil {
+		srv := httptest.NewServer(storage)
+		defer srv.Close()
+		e.Env = append(e.Env, fmt.Sprintf("AzureWebJobsStorage=AccountName=fsb;AccountKey=a2V5;BlobEndpoint=%s/blob;TableEndpoint=%s/table", srv.URL, srv.URL))
+	}
+	e.Output = ioutil.Discard
+
+	responses, err := e.run(context.Background(), requests)
+	require.NoError(t, err)
+	var runs []actionRun
+	if f, err := os.Open(actionLog); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var run actionRun
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &run))
+			runs = append(runs, run)
+		}
+	}
+	return responses, runs
+}
+
+// fakeStorage serves the Blob and Table requests of the functions, without checking their signature.
+type fakeStorage struct {
+	mu sync.Mutex
+	// failBlobs answers blob writes with an error.
+	failBlobs bool
+	blobs     map[string]string
+	// deliveries are the ExpiresAt of recorded deliveries, by ID.
+	deliveries map[string]string
+	// pruneOnRead deletes records once they are read, like the cleanup function running in between.
+	pruneOnRead bool
+	requests    []string
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{blobs: map[string]string{}, deliveries: map[string]string{}}
+}
+
+var deliveryEntityRe = regexp.MustCompile(`^/table/fsbdeliveries\(PartitionKey='delivery',RowKey='(.*)'\)$`)
+
+func (s *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	entity := deliveryEntityRe.FindStringSubmatch(r.URL.Path)
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/blob/") && r.URL.Query().Get("restype") == "container":
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/blob/") && r.Method == http.MethodPut:
+		if s.failBlobs {
+			http.Error(w, "ServerBusy", http.StatusServiceUnavailable)
+			return
+		}
+		s.blobs[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/blob/") && r.Method == http.MethodGet:
+		blob, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, blob)
+	case strings.HasPrefix(r.URL.Path, "/blob/") && r.Method == http.MethodDelete:
+		delete(s.blobs, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.URL.Path == "/table/Tables":
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/table/fsbdeliveries" && r.Method == http.MethodPost:
+		var record struct{ RowKey, ExpiresAt string }
+		_ = json.Unmarshal(body, &record)
+		if _, ok := s.deliveries[record.RowKey]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.deliveries[record.RowKey] = record.ExpiresAt
+		w.WriteHeader(http.StatusNoContent)
+	case entity != nil && r.Method == http.MethodGet:
+		expiresAt, ok := s.deliveries[entity[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if s.pruneOnRead {
+			delete(s.deliveries, entity[1])
+		}
+		w.Header().Set("ETag", `W/"1"`)
+		_ = json.NewEncoder(w).Encode(map[string]string{"RowKey": entity[1], "ExpiresAt": expiresAt})
+	case entity != nil && r.Method == http.MethodPut:
+		if _, ok := s.deliveries[entity[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var record struct{ ExpiresAt string }
+		_ = json.Unmarshal(body, &record)
+		s.deliveries[entity[1]] = record.ExpiresAt
+		w.WriteHeader(http.StatusNoContent)
+	case entity != nil && r.Method == http.MethodDelete:
+		delete(s.deliveries, entity[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// recordedWebhook signs a payload from testdata/webhooks like GitHub.
+func recordedWebhook(t *testing.T, event, file string) hostRequest {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "webhooks", file))
+	require.NoError(t, err)
+	return hostRequest{
+		Headers: map[string]string{
+			"x-github-event":      event,
+			"x-github-delivery":   file,
+			"x-hub-signature-256": signPayload(harnessSecret, body),
+		},
+		Body: string(body),
+	}
+}
+
+func TestPackageFunctionZip_Run(t *testing.T) {
+	created := recordedWebhook(t, "issue_comment", "issue_comment.created.json")
+	forged := recordedWebhook(t, "issue_comment", "issue_comment.created.json")
+	forged.Headers["x-hub-signature-256"] = "sha256=" + hex.EncodeToString(make([]byte, sha256.Size))
+
+	responses, runs := runPackage(t, harnessFlow(t), DeliveryPolicy{Senders: SenderPolicy{Bots: true}}, nil, []hostRequest{
+		created,
+		recordedWebhook(t, "issue_comment", "issue_comment.edited.json"),
+		recordedWebhook(t, "issue_comment", "issue_comment.created.bot.json"),
+		recordedWebhook(t, "push", "push.json"),
+		forged,
+	})
+
+	require.Len(t, responses, 5)
+	assert.Equal(t, 202, responses[0].Status)
+	assert.Equal(t, map[string]interface{}{"id": "issue_comment.created.json"}, responses[0].Body)
+	assert.Contains(t, responses[0].Logs, "FuncSoulBrotherWorker: running delivery issue_comment.created.json, attempt 1")
+	assert.Equal(t, hostResponse{Status: 200, Body: "Ignored event", Logs: []string{}}, responses[1])
+	assert.Equal(t, hostResponse{Status: 200, Body: "Ignored bot github-actions[bot]", Logs: []string{}}, responses[2])
+	assert.Equal(t, hostResponse{Status: 200, Body: "Ignored event", Logs: []string{}}, responses[3])
+	assert.Equal(t, hostResponse{Status: 401, Body: "Signature failed", Logs: []string{}}, responses[4])
+
+	// Only the created comment ran the action, with its inputs and the event:
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, map[string]string{
+			"INPUT_ID":    "Cloud",
+			"INPUT_TOKEN": harnessToken,
+			"GREETING":    "hello",
+		}, runs[0].Env)
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(created.Body), &event))
+		assert.Equal(t, event, runs[0].Event)
+	}
+}
+
+func TestPackageFunctionZip_RunFailures(t *testing.T) {
+	created := []hostRequest{recordedWebhook(t, "issue_comment", "issue_comment.created.json")}
+
+	// A failed step fails the run, which is not retried:
+	failing := harnessFlow(t)
+	failing.Jobs[0].Instances[0].Steps[0].Files = nil
+	responses, runs := runPackage(t, failing, DeliveryPolicy{}, nil, created)
+	require.Len(t, responses, 1)
+	assert.Equal(t, 202, responses[0].Status)
+	assert.Empty(t, runs)
+	assert.Equal(t, []string{
+		"FuncSoulBrother: queued delivery issue_comment.created.json",
+		"FuncSoulBrotherWorker: running delivery issue_comment.created.json, attempt 1",
+		"FuncSoulBrotherWorker: echo-timer: echo-timer-0 failure with 1",
+		`FuncSoulBrotherWorker: delivery issue_comment.created.json: failure [{"name":"echo-timer","ok":false,"instances":[{"name":"echo-timer","conclusion":"failure","steps":[{"name":"echo-timer-0","outcome":"failure","conclusion":"failure"}]}]}]`,
+	}, responses[0].Logs)
+
+	// Errors running the workflow are not retried, the steps may have run:
+	broken := harnessFlow(t)
+	broken.Concurrency = &flows.Concurrency{Group: "${{ github.ref }}"}
+	responses, runs = runPackage(t, broken, DeliveryPolicy{}, nil, created)
+	require.Len(t, responses, 1)
+	assert.Equal(t, 202, responses[0].Status)
+	assert.Empty(t, runs)
+	assert.Equal(t, []string{
+		"FuncSoulBrother: queued delivery issue_comment.created.json",
+		"FuncSoulBrotherWorker: running delivery issue_comment.created.json, attempt 1",
+		"FuncSoulBrotherWorker: concurrency groups require AzureWebJobsStorage",
+		"FuncSoulBrotherWorker: delivery issue_comment.created.json (issue_comment) was interrupted on a previous attempt, not running it again",
+	}, responses[0].Logs)
+}
+
+func TestPackageFunctionZip_RunStrategy(t *testing.T) {
+	flow := harnessFlow(t)
+	template := flow.Jobs[0].Instances[0].Steps[0]
+	step := func(name string, env map[string]string) flows.LoadedStep {
+		s := template
+		s.Name, s.Env = name, env
+		return s
+	}
+	slow := map[string]string{"FSB_ACTION_SLEEP": "10000"}
+	failing := map[string]string{"FSB_ACTION_EXIT": "1"}
+
+	timedOut := step("timeout-0", slow)
+	timedOut.TimeoutMinutes = 0.002
+	timedOut.ContinueOnError = true
+	flow.Jobs = []flows.LoadedJob{
+		{
+			// The step is killed after its timeout, but continues on error:
+			Name:      "timeout",
+			Instances: []flows.JobInstance{{Name: "timeout", Steps: []flows.LoadedStep{timedOut, step("timeout-1", nil)}}},
+		},
+		{
+			// The failure cancels the running instance:
+			Name:     "fail-fast",
+			FailFast: true,
+			Instances: []flows.JobInstance{
+				{Name: "fail-fast (1)", Steps: []flows.LoadedStep{step("fail-fast (1)-0", failing)}},
+				{Name: "fail-fast (2)", Steps: []flows.LoadedStep{step("fail-fast (2)-0", slow)}},
+			},
+		},
+		{
+			// The failure cancels the instance that is waiting to start:
+			Name:        "max-parallel",
+			FailFast:    true,
+			MaxParallel: 1,
+			Instances: []flows.JobInstance{
+				{Name: "max-parallel (1)", Steps: []flows.LoadedStep{step("max-parallel (1)-0", failing)}},
+				{Name: "max-parallel (2)", Steps: []flows.LoadedStep{step("max-parallel (2)-0", nil)}},
+			},
+		},
+		{
+			// A failure that continues on error cancels nothing, and doesn't fail the job:
+			Name:        "continue-on-error",
+			FailFast:    true,
+			MaxParallel: 1,
+			Instances: []flows.JobInstance{
+				{Name: "continue-on-error (1)", ContinueOnError: true, Steps: []flows.LoadedStep{step("continue-on-error (1)-0", failing)}},
+				{Name: "continue-on-error (2)", Steps: []flows.LoadedStep{step("continue-on-error (2)-0", nil)}},
+			},
+		},
+	}
+
+	responses, runs := runPackage(t, flow, DeliveryPolicy{}, nil, []hostRequest{recordedWebhook(t, "issue_comment", "issue_comment.created.json")})
+	require.Len(t, responses, 1)
+	assert.Equal(t, 202, responses[0].Status)
+	// Every step but the slow ones ran to completion:
+	assert.Len(t, runs, 5)
+
+	const prefix = "FuncSoulBrotherWorker: delivery issue_comment.created.json: failure "
+	var results []map[string]interface{}
+	for _, line := range responses[0].Logs {
+		if strings.HasPrefix(line, prefix) {
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, prefix)), &results))
+		}
+	}
+	expected := `[
+  {"name": "timeout", "ok": true, "instances": [{"name": "timeout", "conclusion": "success", "steps": [
+    {"name": "timeout-0", "outcome": "failure", "conclusion": "success"},
+    {"name": "timeout-1", "outcome": "success", "conclusion": "success"}
+  ]}]},
+  {"name": "fail-fast", "ok": false, "instances": [
+    {"name": "fail-fast (1)", "conclusion": "failure", "steps": [{"name": "fail-fast (1)-0", "outcome": "failure", "conclusion": "failure"}]},
+    {"name": "fail-fast (2)", "conclusion": "cancelled", "steps": [{"name": "fail-fast (2)-0", "outcome": "cancelled", "conclusion": "cancelled"}]}
+  ]},
+  {"name": "max-parallel", "ok": false, "instances": [
+    {"name": "max-parallel (1)", "conclusion": "failure", "steps": [{"name": "max-parallel (1)-0", "outcome": "failure", "conclusion": "failure"}]},
+    {"name": "max-parallel (2)", "conclusion": "cancelled", "steps": []}
+  ]},
+  {"name": "continue-on-error", "ok": true, "instances": [
+    {"name": "continue-on-error (1)", "conclusion": "failure", "steps": [{"name": "continue-on-error (1)-0", "outcome": "failure", "conclusion": "failure"}]},
+    {"name": "continue-on-error (2)", "conclusion": "success", "steps": [{"name": "continue-on-error (2)-0", "outcome": "success", "conclusion": "success"}]}
+  ]}
+]`
+	actual, err := json.Marshal(results)
+	require.NoError(t, err)
+	assert.JSONEq(t, expected, string(actual))
+	assert.Contains(t, responses[0].Logs, "FuncSoulBrotherWorker: timeout: timeout-0 timed out")
+}
+
+// editedWebhook signs a recorded payload after changing it.
+func editedWebhook(t *testing.T, event, file string, edit func(map[string]interface{})) hostRequest {
+	req := recordedWebhook(t, event, file)
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(req.Body), &payload))
+	edit(payload)
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+	req.Body = string(body)
+	req.Headers["x-hub-signature-256"] = signPayload(harnessSecret, body)
+	return req
+}
+
+// largeWebhook is a comment of more than 64KB in UTF-8, but fewer characters.
+func largeWebhook(t *testing.T) hostRequest {
+	return editedWebhook(t, "issue_comment", "issue_comment.created.json", func(payload map[string]interface{}) {
+		payload["comment"].(map[string]interface{})["body"] = strings.Repeat("é", 40*1024)
+	})
+}
+
+func TestPackageFunctionZip_RunLargeDelivery(t *testing.T) {
+	storage := newFakeStorage()
+	large := largeWebhook(t)
+	responses, runs := runPackage(t, harnessFlow(t), DeliveryPolicy{}, storage, []hostRequest{large})
+
+	require.Len(t, responses, 1)
+	assert.Equal(t, 202, responses[0].Status)
+	// The payload was kept in a blob, until the worker ran:
+	assert.Contains(t, storage.requests, "PUT /blob/fsb-deliveries/issue_comment.created.json.json")
+	assert.Contains(t, storage.requests, "DELETE /blob/fsb-deliveries/issue_comment.created.json.json")
+	assert.Empty(t, storage.blobs)
+	if assert.Len(t, runs, 1) {
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(large.Body), &event))
+		assert.Equal(t, event, runs[0].Event)
+	}
+}
+
+func TestPackageFunctionZip_RunEnqueueFailure(t *testing.T) {
+	storage := newFakeStorage()
+	storage.failBlobs = true
+	policy := DeliveryPolicy{TTL: time.Hour}
+	responses, runs := runPackage(t, harnessFlow(t), policy, storage, []hostRequest{
+		largeWebhook(t),
+		// GitHub's redelivery, which fits the queue:
+		recordedWebhook(t, "issue_comment", "issue_comment.created.json"),
+	})
+
+	require.Len(t, responses, 2)
+	assert.Equal(t, 500, responses[0].Status)
+	assert.Contains(t, responses[0].Logs, "FuncSoulBrother: storing delivery: 503 ServerBusy\n")
+	// The record was removed, so the redelivery is queued:
+	assert.Contains(t, storage.requests, "DELETE /table/fsbdeliveries(PartitionKey='delivery',RowKey='issue_comment.created.json')")
+	assert.Equal(t, 202, responses[1].Status)
+	assert.Len(t, runs, 1)
+	assert.Contains(t, storage.deliveries, "issue_comment.created.json")
+}
+
+func TestPackageFunctionZip_RunDeliveryLog(t *testing.T) {
+	storage := newFakeStorage()
+	expired := recordedWebhook(t, "issue_comment", "issue_comment.created.json")
+	expired.Headers["x-github-delivery"] = "expired"
+	storage.deliveries["expired"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	responses, runs := runPackage(t, harnessFlow(t), DeliveryPolicy{TTL: time.Hour}, storage, []hostRequest{
+		recordedWebhook(t, "issue_comment", "issue_comment.created.json"),
+		recordedWebhook(t, "issue_comment", "issue_comment.created.json"),
+		expired,
+	})
+
+	require.Len(t, responses, 3)
+	assert.Equal(t, 202, responses[0].Status)
+	assert.Equal(t, hostResponse{Status: 200, Body: "Duplicate delivery", Logs: []string{}}, responses[1])
+	// The expired record was replaced:
+	assert.Equal(t, 202, responses[2].Status)
+	expiresAt, err := time.Parse(time.RFC3339, storage.deliveries["expired"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+	assert.Len(t, runs, 2)
+
+	// An expired record pruned while it is replaced is inserted again:
+	storage.pruneOnRead = true
+	pruned := recordedWebhook(t, "issue_comment", "issue_comment.created.json")
+	pruned.Headers["x-github-delivery"] = "pruned"
+	storage.deliveries["pruned"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	responses, runs = runPackage(t, harnessFlow(t), DeliveryPolicy{TTL: time.Hour}, storage, []hostRequest{pruned})
+	require.Len(t, responses, 1)
+	assert.Equal(t, 202, responses[0].Status)
+	assert.Contains(t, storage.deliveries, "pruned")
+	assert.Len(t, runs, 1)
+}
+
+func TestPackageFunctionZip_RunStale(t *testing.T) {
+	pushedAt := func(t time.Time) func(map[string]interface{}) {
+		return func(payload map[string]interface{}) {
+			payload["repository"].(map[string]interface{})["pushed_at"] = t.Unix()
+		}
+	}
+	responses, runs := runPackage(t, harnessFlow(t), DeliveryPolicy{MaxAge: time.Hour}, nil, []hostRequest{
+		recordedWebhook(t, "issue_comment", "issue_comment.created.json"),
+		// Deleting a comment does not update it, the deletion is not stale:
+		editedWebhook(t, "issue_comment", "issue_comment.created.json", func(payload map[string]interface{}) {
+			payload["action"] = "deleted"
+		}),
+		// Commits pushed now are not stale, however old they are:
+		editedWebhook(t, "push", "push.json", pushedAt(time.Now())),
+		editedWebhook(t, "push", "push.json", pushedAt(time.Now().Add(-2*time.Hour))),
+	})
+
+	require.Len(t, responses, 4)
+	assert.Equal(t, hostResponse{Status: 400, Body: "Stale delivery", Logs: []string{}}, responses[0])
+	assert.Equal(t, hostResponse{Status: 200, Body: "Ignored event", Logs: []string{}}, responses[1])
+	assert.Equal(t, hostResponse{Status: 200, Body: "Ignored event", Logs: []string{}}, responses[2])
+	assert.Equal(t, hostResponse{Status: 400, Body: "Stale delivery", Logs: []string{}}, responses[3])
+	assert.Empty(t, runs)
+}
@@ -0,0 +1,149 @@
+package az
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+// Plan is the Azure Functions hosting plan of deployed workflows.
+type Plan string
+
+const (
+	// ConsumptionPlan scales to zero, but cuts executions off after 10 minutes.
+	ConsumptionPlan Plan = "consumption"
+	// PremiumPlan keeps warm instances, and executions are not cut off.
+	PremiumPlan Plan = "premium"
+)
+
+// ErrTimeoutExceedsPlan is returned for workflows whose timeouts exceed what the plan allows.
+var ErrTimeoutExceedsPlan = errors.New("workflow timeout exceeds the hosting plan's limit")
+
+// timeoutMargin is added to a workflow's timeout, for the function to start and report.
+const timeoutMargin = time.Minute
+
+// ParsePlan parses a plan name.
+func ParsePlan(s string) (Plan, error) {
+	switch p := Plan(s); p {
+	case ConsumptionPlan, PremiumPlan:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown plan %q, expected %q or %q", s, ConsumptionPlan, PremiumPlan)
+	}
+}
+
+// SKU is the App Service plan SKU.
+func (p Plan) SKU() string {
+	if p == PremiumPlan {
+		return "EP1"
+	}
+	return "Y1"
+}
+
+// MaxTimeout is the longest functionTimeout the plan allows, 0 if unbounded.
+func (p Plan) MaxTimeout() time.Duration {
+	if p == PremiumPlan {
+		return 0
+	}
+	return 10 * time.Minute
+}
+
+// concurrencyWait bounds how long a run waits for its concurrency group, before it is cancelled.
+const concurrencyWait = 2 * time.Minute
+
+// RequiredTimeout is the longest a flow may run, from its `timeout-minutes` and waits for concurrency groups.
+// bounded is false if a job can run for as long as the function allows.
+func RequiredTimeout(flow flows.LoadedFlow) (d time.Duration, bounded bool) {
+	bounded = true
+	if flow.Concurrency != nil {
+		d += concurrencyWait
+	}
+	for _, job := range flow.Jobs {
+		var longest time.Duration
+		for _, instance := range job.Instances {
+			timeout, ok := instanceTimeout(instance)
+			if !ok {
+				bounded = false
+			}
+			if instance.Concurrency != nil {
+				timeout += concurrencyWait
+			}
+			if timeout > longest {
+				longest = timeout
+			}
+		}
+		// Instances beyond max-parallel run in later waves:
+		waves := 1
+		if n := len(job.Instances); job.MaxParallel > 0 && n > job.MaxParallel {
+			waves = int(math.Ceil(float64(n) / float64(job.MaxParallel)))
+		}
+		d += time.Duration(waves) * longest
+	}
+	return d, bounded
+}
+
+func instanceTimeout(instance flows.JobInstance) (time.Duration, bool) {
+	if instance.TimeoutMinutes > 0 {
+		return minutes(instance.TimeoutMinutes), true
+	}
+	var d time.Duration
+	for _, step := range instance.Steps {
+		if step.TimeoutMinutes <= 0 {
+			return 0, false
+		}
+		d += minutes(step.TimeoutMinutes)
+	}
+	return d, true
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+// HostJSON generates the function app's host.json, with a functionTimeout fitting the flow.
+// Flows whose timeouts exceed the plan are rejected, unbounded flows are cut off at the plan's limit with a warning.
+func HostJSON(flow flows.LoadedFlow, plan Plan) ([]byte, []string, error) {
+	var warnings []string
+	required, bounded := RequiredTimeout(flow)
+	limit := plan.MaxTimeout()
+	var timeout time.Duration
+	switch {
+	case !bounded:
+		if limit > 0 {
+			warnings = append(warnings, fmt.Sprintf("jobs without timeout-minutes may run for %d minutes on GitHub, but will be cut off after %s on the %s plan", flows.DefaultTimeoutMinutes, limit, plan))
+		}
+		timeout = limit
+	case limit > 0 && required+timeoutMargin > limit:
+		return nil, nil, fmt.Errorf("%w: %s needs %s, the %s plan allows %s", ErrTimeoutExceedsPlan, flow.Name, required, plan, limit)
+	default:
+		timeout = required + timeoutMargin
+	}
+
+	functionTimeout := "-1"
+	if timeout > 0 {
+		functionTimeout = formatTimeout(timeout)
+	}
+	host, err := json.MarshalIndent(map[string]interface{}{
+		"version":         "2.0",
+		"functionTimeout": functionTimeout,
+		"extensions":      queueHostExtensions(),
+		"extensionBundle": map[string]string{
+			"id":      "Microsoft.Azure.Functions.ExtensionBundle",
+			"version": "[1.*, 2.0.0)",
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return host, warnings, nil
+}
+
+// formatTimeout formats a duration as a host.json timespan, rounding up to the second.
+func formatTimeout(d time.Duration) string {
+	s := int64(math.Ceil(d.Seconds()))
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
@@ -0,0 +1,120 @@
+package az_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/az"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestRequiredTimeout(t *testing.T) {
+	step := func(timeout float64) flows.LoadedStep { return flows.LoadedStep{TimeoutMinutes: timeout} }
+	group := &flows.Concurrency{Group: "deploy"}
+	cases := map[string]struct {
+		concurrency *flows.Concurrency
+		jobs        []flows.LoadedJob
+		required    time.Duration
+		bounded     bool
+	}{
+		"job timeout": {
+			jobs:     []flows.LoadedJob{{Instances: []flows.JobInstance{{TimeoutMinutes: 5, Steps: []flows.LoadedStep{step(0)}}}}},
+			required: 5 * time.Minute,
+			bounded:  true,
+		},
+		"step timeouts": {
+			jobs:     []flows.LoadedJob{{Instances: []flows.JobInstance{{Steps: []flows.LoadedStep{step(1), step(0.5)}}}}},
+			required: 90 * time.Second,
+			bounded:  true,
+		},
+		"unbounded": {
+			jobs:    []flows.LoadedJob{{Instances: []flows.JobInstance{{Steps: []flows.LoadedStep{step(1), step(0)}}}}},
+			bounded: false,
+		},
+		"jobs run sequentially, instances in waves": {
+			jobs: []flows.LoadedJob{
+				{Instances: []flows.JobInstance{{TimeoutMinutes: 1}}},
+				{
+					MaxParallel: 2,
+					Instances:   []flows.JobInstance{{TimeoutMinutes: 2}, {TimeoutMinutes: 3}, {TimeoutMinutes: 1}},
+				},
+			},
+			required: 7 * time.Minute,
+			bounded:  true,
+		},
+		"concurrency groups are waited for": {
+			concurrency: group,
+			jobs: []flows.LoadedJob{
+				{Instances: []flows.JobInstance{{TimeoutMinutes: 1, Concurrency: group}, {TimeoutMinutes: 2}}},
+			},
+			required: 5 * time.Minute,
+			bounded:  true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			required, bounded := az.RequiredTimeout(flows.LoadedFlow{Concurrency: tc.concurrency, Jobs: tc.jobs})
+			assert.Equal(t, tc.required, required)
+			assert.Equal(t, tc.bounded, bounded)
+		})
+	}
+}
+
+func TestHostJSON(t *testing.T) {
+	flow := func(timeout float64) flows.LoadedFlow {
+		return flows.LoadedFlow{Name: "wf.yml", Jobs: []flows.LoadedJob{{Instances: []flows.JobInstance{{TimeoutMinutes: timeout, Steps: []flows.LoadedStep{{Name: "step"}}}}}}}
+	}
+	functionTimeout := func(t *testing.T, host []byte) string {
+		var parsed struct {
+			Version         string
+			FunctionTimeout string
+			Extensions      struct {
+				Queues struct {
+					MaxDequeueCount int
+				}
+			}
+		}
+		require.NoError(t, json.Unmarshal(host, &parsed))
+		assert.Equal(t, "2.0", parsed.Version)
+		assert.Equal(t, 3, parsed.Extensions.Queues.MaxDequeueCount)
+		return parsed.FunctionTimeout
+	}
+
+	host, warnings, err := az.HostJSON(flow(5), az.ConsumptionPlan)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, "00:06:00", functionTimeout(t, host))
+
+	_, _, err = az.HostJSON(flow(30), az.ConsumptionPlan)
+	assert.True(t, errors.Is(err, az.ErrTimeoutExceedsPlan))
+
+	host, warnings, err = az.HostJSON(flow(30), az.PremiumPlan)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, "00:31:00", functionTimeout(t, host))
+
+	host, warnings, err = az.HostJSON(flow(0), az.ConsumptionPlan)
+	require.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "00:10:00", functionTimeout(t, host))
+
+	host, warnings, err = az.HostJSON(flow(0), az.PremiumPlan)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, "-1", functionTimeout(t, host))
+}
+
+func TestParsePlan(t *testing.T) {
+	plan, err := az.ParsePlan("premium")
+	require.NoError(t, err)
+	assert.Equal(t, az.PremiumPlan, plan)
+	assert.Equal(t, "EP1", plan.SKU())
+	assert.Equal(t, "Y1", az.ConsumptionPlan.SKU())
+
+	_, err = az.ParsePlan("dedicated")
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package az
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+// PriceModel prices a converted workflow on the Azure Functions consumption plan, against GitHub hosted runners.
+// Monthly free grants are per subscription, so they are not deducted from per-workflow estimates.
+type PriceModel struct {
+	// PerMillionExecutions and PerGBSecond are the consumption plan prices, in USD.
+	PerMillionExecutions float64
+	PerGBSecond          float64
+	// MemoryGB used by a function execution; billed in 128MB increments.
+	MemoryGB float64
+	// StepSeconds is the expected execution time of a converted step.
+	StepSeconds float64
+	// ColdStartSeconds is the expected latency before a function starts executing.
+	ColdStartSeconds float64
+	// RunnerPerMinute is the price of a GitHub hosted runner minute, in USD.
+	RunnerPerMinute float64
+}
+
+// DefaultPriceModel uses list prices for Linux runners and the consumption plan.
+var DefaultPriceModel = PriceModel{
+	PerMillionExecutions: 0.20,
+	PerGBSecond:          0.000016,
+	MemoryGB:             0.25,
+	StepSeconds:          2,
+	ColdStartSeconds:     5,
+	RunnerPerMinute:      0.008,
+}
+
+// ReadPriceModel reads a JSON price model, defaulting omitted fields to DefaultPriceModel.
+func ReadPriceModel(path string) (PriceModel, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PriceModel{}, fmt.Errorf("reading price model: %w", err)
+	}
+	m := DefaultPriceModel
+	if err := json.Unmarshal(b, &m); err != nil {
+		return PriceModel{}, fmt.Errorf("parsing price model: %w", err)
+	}
+	return m, nil
+}
+
+// Estimate compares a workflow on runners with its conversion to a function.
+type Estimate struct {
+	RunsPerMonth float64
+	// RunnerLatency is the mean queue and run time on runners; FunctionLatency the expected time as a function.
+	RunnerLatency   time.Duration
+	FunctionLatency time.Duration
+	// Monthly costs, in USD.
+	RunnerCost   float64
+	FunctionCost float64
+}
+
+// LatencySaved is the expected time saved per run by converting.
+func (e Estimate) LatencySaved() time.Duration {
+	return e.RunnerLatency - e.FunctionLatency
+}
+
+// Estimate a workflow of steps, given its history on runners.
+func (m PriceModel) Estimate(steps int, history flows.RunHistory) Estimate {
+	e := Estimate{
+		RunsPerMonth:  history.RunsPerMonth(),
+		RunnerLatency: history.QueueTime + history.RunTime,
+	}
+	execSeconds := float64(steps) * m.StepSeconds
+	e.FunctionLatency = time.Duration((m.ColdStartSeconds + execSeconds) * float64(time.Second))
+
+	// 128MB increments, in GB:
+	memoryGB := math.Ceil(m.MemoryGB/0.125) * 0.125
+	perRun := m.PerMillionExecutions/1e6 + memoryGB*execSeconds*m.PerGBSecond
+	e.FunctionCost = e.RunsPerMonth * perRun
+	e.RunnerCost = e.RunsPerMonth * history.RunnerMinutes * m.RunnerPerMinute
+	return e
+}
@@ -0,0 +1,57 @@
+package az_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/az"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestPriceModel_Estimate(t *testing.T) {
+	since := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	history := flows.RunHistory{
+		Runs:          11,
+		Since:         since,
+		Until:         since.Add(3 * 24 * time.Hour),
+		QueueTime:     20 * time.Second,
+		RunTime:       40 * time.Second,
+		RunnerMinutes: 1,
+	}
+	model := az.PriceModel{
+		PerMillionExecutions: 0.20,
+		PerGBSecond:          0.000016,
+		MemoryGB:             0.2,
+		StepSeconds:          2,
+		ColdStartSeconds:     4,
+		RunnerPerMinute:      0.008,
+	}
+
+	e := model.Estimate(3, history)
+	assert.InDelta(t, 100, e.RunsPerMonth, 0.001)
+	assert.Equal(t, time.Minute, e.RunnerLatency)
+	assert.Equal(t, 10*time.Second, e.FunctionLatency)
+	assert.Equal(t, 50*time.Second, e.LatencySaved())
+	assert.InDelta(t, 0.8, e.RunnerCost, 0.000001)
+	// 100 runs * (0.20/1M + 0.25GB * 6s * 0.000016)
+	assert.InDelta(t, 0.00242, e.FunctionCost, 0.0000001)
+}
+
+func TestReadPriceModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-prices")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "prices.json")
+	require.NoError(t, ioutil.WriteFile(p, []byte(`{"StepSeconds": 10}`), 0600))
+
+	m, err := az.ReadPriceModel(p)
+	require.NoError(t, err)
+	expected := az.DefaultPriceModel
+	expected.StepSeconds = 10
+	assert.Equal(t, expected, m)
+}
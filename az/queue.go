@@ -0,0 +1,49 @@
+package az
+
+import "time"
+
+// Deliveries are acknowledged by the HTTP function and run by the worker, so GitHub's webhook timeout
+// never waits on the workflow. The worker drops messages that are delivered again, those that still fail are
+// moved to the poison queue by the host.
+const (
+	deliveryQueue       = "deliveries"
+	poisonDeliveryQueue = deliveryQueue + "-poison"
+	maxDequeueCount     = 3
+	retryDelay          = 30 * time.Second
+	pollingInterval     = 2 * time.Second
+)
+
+var deliveryBindings = []byte(`{
+  "bindings": [
+    {
+      "type": "queueTrigger",
+      "direction": "in",
+      "name": "message",
+      "queueName": "` + deliveryQueue + `",
+      "connection": "AzureWebJobsStorage"
+    }
+  ]
+}`)
+
+var poisonBindings = []byte(`{
+  "bindings": [
+    {
+      "type": "queueTrigger",
+      "direction": "in",
+      "name": "message",
+      "queueName": "` + poisonDeliveryQueue + `",
+      "connection": "AzureWebJobsStorage"
+    }
+  ]
+}`)
+
+// queueHostExtensions configures how the host polls and retries the delivery queue.
+func queueHostExtensions() map[string]interface{} {
+	return map[string]interface{}{
+		"queues": map[string]interface{}{
+			"maxPollingInterval": formatTimeout(pollingInterval),
+			"visibilityTimeout":  formatTimeout(retryDelay),
+			"maxDequeueCount":    maxDequeueCount,
+		},
+	}
+}
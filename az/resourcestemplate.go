@@ -31,6 +31,14 @@ func init() {
         "description": "The name of the function app that you wish to create."
       }
     },
+    "planSku": {
+      "type": "string",
+      "defaultValue": "Y1",
+      "allowedValues": ["Y1", "EP1", "EP2", "EP3"],
+      "metadata": {
+        "description": "Y1 for the Consumption plan, EP* for Elastic Premium plans without execution limits"
+      }
+    },
     "storageAccountType": {
       "type": "string",
       "defaultValue": "Standard_LRS",
@@ -52,7 +60,8 @@ func init() {
     "hostingPlanName": "[parameters('appName')]",
     "applicationInsightsName": "[parameters('appName')]",
     "storageAccountName": "[parameters('cleanAppName')]",
-    "storageAccountid": "[concat(resourceGroup().id,'/providers/','Microsoft.Storage/storageAccounts/', variables('storageAccountName'))]"
+    "storageAccountid": "[concat(resourceGroup().id,'/providers/','Microsoft.Storage/storageAccounts/', variables('storageAccountName'))]",
+    "premium": "[not(equals(parameters('planSku'), 'Y1'))]"
   },
   "resources": [
     {
@@ -69,15 +78,15 @@ func init() {
       "type": "Microsoft.Web/serverfarms",
       "apiVersion": "2019-08-01",
       "name": "[variables('hostingPlanName')]",
-      "kind": "functionapp",
+      "kind": "[if(variables('premium'), 'elastic', 'functionapp')]",
       "location": "[parameters('location')]",
       "sku": {
-        "name": "Y1",
-        "tier": "Dynamic"
+        "name": "[parameters('planSku')]",
+        "tier": "[if(variables('premium'), 'ElasticPremium', 'Dynamic')]"
       },
       "properties": {
         "name": "[variables('hostingPlanName')]",
-        "computeMode": "Dynamic",
+        "maximumElasticWorkerCount": "[if(variables('premium'), 20, 1)]",
         "reserved": true
       }
     },
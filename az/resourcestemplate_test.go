@@ -10,4 +10,10 @@ func TestAzureResourcesTemplate(t *testing.T) {
 	if assert.Contains(t, azureResourcesTemplate, "$schema") {
 		assert.Equal(t, "https://schema.management.azure.com/schemas/2015-01-01/deploymentTemplate.json#", azureResourcesTemplate["$schema"])
 	}
+	if assert.Contains(t, azureResourcesTemplate, "parameters") {
+		params := azureResourcesTemplate["parameters"].(map[string]interface{})
+		if assert.Contains(t, params, "planSku") {
+			assert.Equal(t, "Y1", params["planSku"].(map[string]interface{})["defaultValue"])
+		}
+	}
 }
@@ -0,0 +1,37 @@
+package az
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+// SenderPolicy ignores events caused by automation, like events caused by a workflow's GITHUB_TOKEN
+// don't trigger workflows. Otherwise a workflow replying to comments would reply to its own replies.
+type SenderPolicy struct {
+	// Logins ignores events sent by these users, e.g. the user of the deployed token.
+	Logins []string
+	// Bots ignores events sent by any bot account.
+	Bots bool
+	// AppID ignores events performed via this GitHub App, e.g. the app of a deployed installation token.
+	AppID int64
+}
+
+// Warnings describes loops the policy lets the flow run into, when its steps can cause the events that trigger it.
+func (p SenderPolicy) Warnings(flow flows.LoadedFlow) []string {
+	if len(p.Logins) > 0 || p.Bots || p.AppID != 0 {
+		return nil
+	}
+	var events []string
+	for _, t := range flow.Triggers {
+		// Only schedules are not caused by a token:
+		if t.Event != "schedule" {
+			events = append(events, t.Event)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("no senders are ignored, events the workflow's token causes (%s) trigger it again: ignore bots, the token's user or its app", strings.Join(events, ", "))}
+}
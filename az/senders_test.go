@@ -0,0 +1,20 @@
+package az_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thepwagner/func-soul-brother/az"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestSenderPolicy_Warnings(t *testing.T) {
+	comments := flows.LoadedFlow{Triggers: []flows.Trigger{{Event: "issue_comment", Actions: []string{"created"}}}}
+	assert.Len(t, az.SenderPolicy{}.Warnings(comments), 1)
+	assert.Empty(t, az.SenderPolicy{Bots: true}.Warnings(comments))
+	assert.Empty(t, az.SenderPolicy{Logins: []string{"fsb-bot"}}.Warnings(comments))
+	assert.Empty(t, az.SenderPolicy{AppID: 1}.Warnings(comments))
+
+	scheduled := flows.LoadedFlow{Triggers: []flows.Trigger{{Event: "schedule"}}}
+	assert.Empty(t, az.SenderPolicy{}.Warnings(scheduled))
+}
@@ -1,12 +1,16 @@
 package az
 
 import (
+	"embed"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"text/template"
 
 	"github.com/thepwagner/func-soul-brother/flows"
 )
 
+// functionBindings include the delivery queue, which is only written through the binding when run locally without storage.
 var functionBindings = []byte(`{
   "bindings": [
     {
@@ -23,91 +27,163 @@ var functionBindings = []byte(`{
       "type": "http",
       "direction": "out",
       "name": "res"
+    },
+    {
+      "type": "queue",
+      "direction": "out",
+      "name": "delivery",
+      "queueName": "` + deliveryQueue + `",
+      "connection": "AzureWebJobsStorage"
     }
   ]
 }`)
 
-func GenerateEntrypoint(secret, token string, flow flows.LoadedFlow) string {
+// templates render the functions' JavaScript. Values are only ever emitted as JSON, which is valid JS;
+// the shared .js files are included verbatim, so they are not parsed as templates.
+//
+//go:embed templates
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"json":    jsLiteral,
+	"include": includeJS,
+}).ParseFS(templateFS, "templates/*.tmpl"))
+
+// jsLiteral encodes a value as JSON, escaping U+2028 and U+2029 that older JS engines reject in strings.
+func jsLiteral(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func includeJS(name string) (string, error) {
+	b, err := templateFS.ReadFile("templates/" + name)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func render(name string, data interface{}) (string, error) {
 	var s strings.Builder
+	if err := templates.ExecuteTemplate(&s, name, data); err != nil {
+		return "", fmt.Errorf("rendering %s: %w", name, err)
+	}
+	return s.String(), nil
+}
 
-	// Imports and constants:
-	s.WriteString(`
-const fs = require('fs');
-const verify = require('@octokit/webhooks/verify');
-`)
-	_, _ = fmt.Fprintf(&s, "const secret = %q;\n", secret)
-
-	// Function entrypoint, verify HMAC:
-	s.WriteString(`
-module.exports = async function (context, req) {
-  if (!verify(secret, req.body, req.headers['x-hub-signature'])) {
-    context.res = {
-      status: 401,
-      body: "Signature failed"
-    };
-    return;
-  }
-
-`)
-
-	// Filter out events that don't trigger the workflow:
-	for _, l := range strings.Split(GenerateFilterFunction(flow.Triggers), "\n") {
-		_, _ = fmt.Fprintf(&s, "  %s\n", l)
+// GenerateEntrypoint generates the HTTP function, which acknowledges deliveries of events that trigger the flow.
+// Deliveries signed with any of the secrets are accepted, so secrets can be rotated.
+func GenerateEntrypoint(secrets []string, flow flows.LoadedFlow, policy DeliveryPolicy) (string, error) {
+	return render("entrypoint.js.tmpl", struct {
+		Secrets  []string
+		Policy   interface{}
+		Queue    string
+		Triggers []flows.Trigger
+	}{Secrets: secrets, Policy: policy.js(), Queue: deliveryQueue, Triggers: flow.Triggers})
+}
+
+// ParseWebhookSecrets reads one secret per line, e.g. the new and the old secret while rotating.
+func ParseWebhookSecrets(s string) []string {
+	var secrets []string
+	for _, line := range strings.Split(s, "\n") {
+		if secret := strings.TrimSpace(line); secret != "" {
+			secrets = append(secrets, secret)
+		}
 	}
-	s.WriteString(`
-  if (!filterEvent(req)) {
-    context.res = {
-      status: 200,
-      body: "Ignored event"
-    };
-    return;
-  }
-`)
-
-	// HACK: ignore comments from actions for a smoother "reply to comments" demo
-	s.WriteString(`
-  if (req.body.comment && req.body.comment.user.login === 'github-actions[bot]') {
-    context.res = {
-      status: 200,
-      body: "ignoring actions"
-    };
-    return;
-  }
-`)
-
-	s.WriteString(`
-  const eventFile = '/tmp/eventPayload.json';
-  fs.writeFileSync(eventFile, JSON.stringify(req.body));
-  process.env.GITHUB_EVENT_PATH = eventFile;  
-  context.log('wrote event JSON, invoking action');
-`)
-
-	for _, f := range flow.Steps {
-		_, _ = fmt.Fprintln(&s)
-		for k, v := range f.Inputs {
-			// HACK: replace identifier, so race in demo is clear:
-			if k == "id" && v == "Cloud" {
-				v = "Azure Functions"
-			}
+	return secrets
+}
+
+// GenerateWorker generates the queue function, which runs the flow for each delivery.
+func GenerateWorker(token string, flow flows.LoadedFlow) (string, error) {
+	return render("worker.js.tmpl", struct{ Plan plan }{Plan: executionPlan(token, flow)})
+}
+
+// GeneratePoisonHandler generates the function that gives up on deliveries the worker failed to run.
+func GeneratePoisonHandler() (string, error) {
+	return render("poison.js.tmpl", struct{ MaxDequeueCount int }{MaxDequeueCount: maxDequeueCount})
+}
+
+// plan is a LoadedFlow, as executed by the entrypoint.
+type plan struct {
+	Workflow    string             `json:"workflow"`
+	Concurrency *flows.Concurrency `json:"concurrency"`
+	// ConcurrencyWaitSeconds bounds the wait for a concurrency group, as RequiredTimeout expects.
+	ConcurrencyWaitSeconds float64   `json:"concurrencyWaitSeconds"`
+	Jobs                   []planJob `json:"jobs"`
+}
+
+// planJob is a LoadedJob, as executed by the entrypoint.
+type planJob struct {
+	Name        string         `json:"name"`
+	FailFast    bool           `json:"failFast"`
+	MaxParallel int            `json:"maxParallel"`
+	Instances   []planInstance `json:"instances"`
+}
 
-			// Replace token with provided PAT
-			switch strings.Join(strings.Fields(v), "") {
-			case "${{secrets.GITHUB_TOKEN}}":
-				v = token
+type planInstance struct {
+	Name            string             `json:"name"`
+	TimeoutMinutes  float64            `json:"timeoutMinutes"`
+	ContinueOnError bool               `json:"continueOnError"`
+	Concurrency     *flows.Concurrency `json:"concurrency"`
+	Steps           []planStep         `json:"steps"`
+}
+
+type planStep struct {
+	Name            string            `json:"name"`
+	Main            string            `json:"main"`
+	Env             map[string]string `json:"env"`
+	TimeoutMinutes  float64           `json:"timeoutMinutes"`
+	ContinueOnError bool              `json:"continueOnError"`
+}
+
+// executionPlan resolves the jobs of a flow into the environment of every step.
+func executionPlan(token string, flow flows.LoadedFlow) plan {
+	jobs := make([]planJob, 0, len(flow.Jobs))
+	for _, job := range flow.Jobs {
+		pj := planJob{Name: job.Name, FailFast: job.FailFast, MaxParallel: job.MaxParallel}
+		for _, instance := range job.Instances {
+			pi := planInstance{
+				Name:            instance.Name,
+				TimeoutMinutes:  instance.TimeoutMinutes,
+				ContinueOnError: instance.ContinueOnError,
+				Concurrency:     instance.Concurrency,
 			}
-			_, _ = fmt.Fprintf(&s, "  process.env.INPUT_%s = %q;\n", strings.ToUpper(k), v)
+			for _, step := range instance.Steps {
+				env := make(map[string]string, len(step.Env)+len(step.Inputs))
+				for k, v := range step.Env {
+					env[k] = resolveValue(v, token)
+				}
+				for k, v := range step.Inputs {
+					env["INPUT_"+strings.ToUpper(k)] = resolveValue(v, token)
+				}
+				pi.Steps = append(pi.Steps, planStep{
+					Name:            step.Name,
+					Main:            step.MainPath(),
+					Env:             env,
+					TimeoutMinutes:  step.TimeoutMinutes,
+					ContinueOnError: step.ContinueOnError,
+				})
+			}
+			pj.Instances = append(pj.Instances, pi)
 		}
+		jobs = append(jobs, pj)
+	}
+	return plan{
+		Workflow:               flow.Name,
+		Concurrency:            flow.Concurrency,
+		ConcurrencyWaitSeconds: concurrencyWait.Seconds(),
+		Jobs:                   jobs,
+	}
+}
 
-		fn := f.Filename()
-		_, _ = fmt.Fprintf(&s, "  delete require.cache[require.resolve('../%s')];\n", fn)
-		_, _ = fmt.Fprintf(&s, "  await require('../%s');\n", fn)
+// resolveValue replaces expressions that are known at deploy time.
+func resolveValue(v, token string) string {
+	// Replace token with provided PAT
+	if flows.IsTokenExpression(v) {
+		return token
 	}
-	s.WriteString(`
-  context.res = {
-    status: 200,
-    body: "subprocess complete"
-  };
-};
-`)
-	return s.String()
+	return v
 }
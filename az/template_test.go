@@ -1,29 +1,342 @@
 package az_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/func-soul-brother/az"
 	"github.com/thepwagner/func-soul-brother/flows"
 )
 
 func TestGenerateEntrypoint(t *testing.T) {
-	entrypoint := az.GenerateEntrypoint("topSecret", "testToken", flows.LoadedFlow{
+	entrypoint, err := az.GenerateEntrypoint([]string{"topSecret", "oldSecret"}, flows.LoadedFlow{
+		Name:     "test",
+		Triggers: []flows.Trigger{{Event: "issue_comment"}},
+	}, az.DeliveryPolicy{TTL: time.Hour, MaxAge: time.Minute})
+	require.NoError(t, err)
+	t.Log(entrypoint)
+	assert.Contains(t, entrypoint, `const secrets = ["topSecret","oldSecret"];`)
+	assert.NotContains(t, entrypoint, `x-hub-signature'`)
+	assert.Contains(t, entrypoint, `context.bindings.delivery = delivery;`)
+	assert.Contains(t, entrypoint, `status: 202`)
+	assert.Contains(t, entrypoint, `const deliveryPolicy = {"ttlSeconds":3600,"maxAgeSeconds":60,"logins":[],"bots":false,"appId":0};`)
+	assert.NotContains(t, entrypoint, `const plan`)
+}
+
+// entrypointHarness calls the entrypoint with each delivery, printing the response statuses.
+const entrypointHarness = `
+const entrypoint = require(process.argv[1]);
+const deliveries = JSON.parse(process.argv[2]);
+(async () => {
+  const statuses = [];
+  for (const d of deliveries) {
+    const context = { log: () => {}, bindings: {} };
+    let body = {};
+    try {
+      body = JSON.parse(d.body);
+    } catch (e) {
+    }
+    await entrypoint(context, { headers: d.headers, rawBody: d.body, body });
+    statuses.push(context.res.status);
+  }
+  console.log(JSON.stringify(statuses));
+})();
+`
+
+type delivery struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// runEntrypoint runs the generated HTTP function with node, returning the response status of each delivery.
+func runEntrypoint(t *testing.T, entrypoint string, deliveries ...delivery) []int {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	dir, err := ioutil.TempDir("", "fsb-entrypoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entrypointPath := filepath.Join(dir, "index.js")
+	require.NoError(t, ioutil.WriteFile(entrypointPath, []byte(entrypoint), 0644))
+
+	deliveriesJSON, err := json.Marshal(deliveries)
+	require.NoError(t, err)
+	out, err := exec.Command(node, "-e", entrypointHarness, entrypointPath, string(deliveriesJSON)).CombinedOutput()
+	require.NoError(t, err, string(out))
+	var statuses []int
+	require.NoError(t, json.Unmarshal(out, &statuses), string(out))
+	return statuses
+}
+
+func TestGenerateEntrypoint_Signatures(t *testing.T) {
+	// Known vector from GitHub's documentation on validating webhook deliveries:
+	const docSecret = "It's a Secret to Everybody"
+	const docBody = "Hello, World!"
+	const docSignature = "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+	assert.Equal(t, docSignature, sign(docSecret, docBody))
+
+	// Deliveries are filtered after verification, so accepted deliveries are ignored with a 200:
+	entrypoint, err := az.GenerateEntrypoint([]string{"newSecret", docSecret}, flows.LoadedFlow{
+		Triggers: []flows.Trigger{{Event: "push"}},
+	}, az.DeliveryPolicy{})
+	require.NoError(t, err)
+	signed := func(signature, body string) delivery {
+		return delivery{Headers: map[string]string{"x-github-event": "ping", "x-hub-signature-256": signature}, Body: body}
+	}
+	rawBody := `{"zen":  "Keep it logically awesome."}`
+	statuses := runEntrypoint(t, entrypoint,
+		signed(docSignature, docBody),
+		signed(sign("newSecret", rawBody), rawBody),
+		signed(sign("newSecret", `{"zen":"Keep it logically awesome."}`), rawBody),
+		signed(sign("retiredSecret", rawBody), rawBody),
+		signed(strings.TrimPrefix(docSignature, "sha256="), docBody),
+		signed(docSignature[:len(docSignature)-2], docBody),
+		delivery{Headers: map[string]string{"x-github-event": "ping", "x-hub-signature": "sha1=01dc10d0c83e72ed246219cdd91669667fe2ca59"}, Body: docBody},
+	)
+	assert.Equal(t, []int{200, 200, 401, 401, 401, 401, 401}, statuses)
+}
+
+func TestGenerateEntrypoint_Senders(t *testing.T) {
+	entrypoint, err := az.GenerateEntrypoint([]string{"secret"}, flows.LoadedFlow{
+		Triggers: []flows.Trigger{{Event: "issue_comment"}},
+	}, az.DeliveryPolicy{Senders: az.SenderPolicy{Logins: []string{"FSB-Deployer"}, Bots: true, AppID: 42}})
+	require.NoError(t, err)
+	comment := func(sender, senderType string, appID int) delivery {
+		body := fmt.Sprintf(`{"action":"created","sender":{"login":%q,"type":%q},"comment":{"performed_via_github_app":{"id":%d,"slug":"app"}}}`, sender, senderType, appID)
+		return delivery{Headers: map[string]string{"x-github-event": "issue_comment", "x-hub-signature-256": sign("secret", body)}, Body: body}
+	}
+
+	// Queued deliveries are accepted with a 202:
+	statuses := runEntrypoint(t, entrypoint,
+		comment("octocat", "User", 1),
+		comment("fsb-deployer", "User", 1),
+		comment("dependabot[bot]", "Bot", 1),
+		comment("octocat", "User", 42),
+	)
+	assert.Equal(t, []int{202, 200, 200, 200}, statuses)
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestGenerateWorker(t *testing.T) {
+	entrypoint, err := az.GenerateWorker("testToken", flows.LoadedFlow{
 		Name: "test",
 		Triggers: []flows.Trigger{
 			{Event: "issue_comment"},
 		},
-		Steps: []flows.LoadedStep{
-			{
-				Name: "step1",
-				Inputs: map[string]string{
-					"my_cool_token": "${{ secrets.GITHUB_TOKEN }}",
-				},
-			},
-		},
+		Concurrency: &flows.Concurrency{Group: "${{ github.ref }}", CancelInProgress: true},
+		Jobs: []flows.LoadedJob{{
+			Name:        "job",
+			FailFast:    true,
+			MaxParallel: 2,
+			Instances: []flows.JobInstance{{
+				Name:            "job",
+				TimeoutMinutes:  10,
+				ContinueOnError: true,
+				Steps: []flows.LoadedStep{{
+					Name:           "step1",
+					Action:         flows.ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"},
+					SHA:            "0123456789abcdef0123456789abcdef01234567",
+					Main:           "dist/index.js",
+					TimeoutMinutes: 1.5,
+					Inputs: map[string]string{
+						"my_cool_token": "${{ secrets.GITHUB_TOKEN }}",
+						"default_token": "${{ github.token }}",
+					},
+					Env: map[string]string{
+						"GREETING": "hello",
+						"GH_TOKEN": "${{ secrets.GITHUB_TOKEN }}",
+					},
+				}},
+			}},
+		}},
 	})
+	require.NoError(t, err)
 	t.Log(entrypoint)
-	assert.Contains(t, entrypoint, `process.env.INPUT_MY_COOL_TOKEN = "testToken";`)
+	assert.Contains(t, entrypoint, `"INPUT_MY_COOL_TOKEN":"testToken"`)
+	assert.Contains(t, entrypoint, `"INPUT_DEFAULT_TOKEN":"testToken"`)
+	assert.Contains(t, entrypoint, `"GREETING":"hello"`)
+	assert.Contains(t, entrypoint, `"GH_TOKEN":"testToken"`)
+	assert.Contains(t, entrypoint, `"main":"actions/thepwagner/echo-timer/0123456789abcdef0123456789abcdef01234567/dist/index.js"`)
+	assert.Contains(t, entrypoint, `"failFast":true`)
+	assert.Contains(t, entrypoint, `"maxParallel":2`)
+	assert.Contains(t, entrypoint, `"timeoutMinutes":10`)
+	assert.Contains(t, entrypoint, `"timeoutMinutes":1.5`)
+	assert.Contains(t, entrypoint, `"continueOnError":true`)
+	assert.Contains(t, entrypoint, `"group":"${{ github.ref }}"`)
+	assert.Contains(t, entrypoint, `"cancelInProgress":true`)
+	assert.NotContains(t, entrypoint, "topSecret")
+}
+
+func TestParseWebhookSecrets(t *testing.T) {
+	assert.Equal(t, []string{"new", "old"}, az.ParseWebhookSecrets("new\n  old \n\n"))
+	assert.Empty(t, az.ParseWebhookSecrets(" \n"))
+}
+
+// jsParser compiles each file without running it, printing the errors.
+const jsParser = `
+const fs = require('fs');
+const vm = require('vm');
+const errors = [];
+for (const file of process.argv.slice(1)) {
+  try {
+    new vm.Script(fs.readFileSync(file, 'utf8'), { filename: file });
+  } catch (err) {
+    errors.push(file + ': ' + err.message);
+  }
+}
+console.log(JSON.stringify(errors));
+`
+
+// jsInputs are strings that Go's %q would not quote as valid JS.
+var jsInputs = []string{
+	`"`, `'`, "`", `\`, `\x41`, "\\u2028", "\u2028", "\u2029", "\x00", "\x7f", "\xff", "\ufeff",
+	"line\nbreak", "\r\n", "</script>", "*/", "${x}", "${{ github.ref }}", "\U0001F600",
+}
+
+// randomJSInputs generates strings from characters that are special to JS, JSON and Go.
+func randomJSInputs(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	alphabet := []rune("\"'`\\/${}*\n\r\t\x00\x1f\x7f\u0085\u00a0\u2028\u2029\ufeff\U0001F600aZ09")
+	inputs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		s := make([]rune, 1+r.Intn(16))
+		for j := range s {
+			s[j] = alphabet[r.Intn(len(alphabet))]
+		}
+		inputs = append(inputs, string(s))
+	}
+	return inputs
+}
+
+func TestGenerate_ValidJS(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	dir, err := ioutil.TempDir("", "fsb-syntax")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var files []string
+	write := func(name, js string, err error) {
+		require.NoError(t, err)
+		fn := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(fn, []byte(js), 0644))
+		files = append(files, fn)
+	}
+	for i, v := range append(jsInputs, randomJSInputs(50)...) {
+		flow := flows.LoadedFlow{
+			Name:        v,
+			Triggers:    []flows.Trigger{{Event: v}, {Event: "issue_comment", Actions: []string{v, "created"}}},
+			Concurrency: &flows.Concurrency{Group: v},
+			Jobs: []flows.LoadedJob{{
+				Name: v,
+				Instances: []flows.JobInstance{{
+					Name: v,
+					Steps: []flows.LoadedStep{{
+						Name:   v,
+						Action: flows.ActionReference{RepoOwner: "o", RepoName: "r"},
+						Main:   v,
+						Inputs: map[string]string{v: v},
+						Env:    map[string]string{v: v},
+					}},
+				}},
+			}},
+		}
+		policy := az.DeliveryPolicy{Senders: az.SenderPolicy{Logins: []string{v}}}
+
+		entrypoint, err := az.GenerateEntrypoint([]string{v}, flow, policy)
+		write(fmt.Sprintf("entrypoint%d.js", i), entrypoint, err)
+		worker, err := az.GenerateWorker(v, flow)
+		write(fmt.Sprintf("worker%d.js", i), worker, err)
+		cleanup, err := az.GenerateCleanup(policy)
+		write(fmt.Sprintf("cleanup%d.js", i), cleanup, err)
+	}
+	poison, err := az.GeneratePoisonHandler()
+	write("poison.js", poison, err)
+
+	out, err := exec.Command(node, append([]string{"-e", jsParser}, files...)...).CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.JSONEq(t, `[]`, string(out))
+}
+
+// filterHarness evaluates the filter for each request, printing the matches.
+const filterHarness = `
+const vm = require('vm');
+const filterEvent = vm.runInNewContext(process.argv[1] + '; filterEvent');
+console.log(JSON.stringify(JSON.parse(process.argv[2]).map((req) => filterEvent(req))));
+`
+
+func TestGenerateFilterFunction_Inputs(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	type request struct {
+		Headers map[string]string      `json:"headers"`
+		Body    map[string]interface{} `json:"body"`
+	}
+	var triggers []flows.Trigger
+	var requests []request
+	var expected []bool
+	for _, v := range append(jsInputs, randomJSInputs(20)...) {
+		triggers = append(triggers, flows.Trigger{Event: "event" + v}, flows.Trigger{Event: "issue_comment", Actions: []string{"action" + v}})
+		requests = append(requests,
+			request{Headers: map[string]string{"x-github-event": "event" + v}, Body: map[string]interface{}{}},
+			request{Headers: map[string]string{"x-github-event": "issue_comment"}, Body: map[string]interface{}{"action": "action" + v}},
+		)
+		expected = append(expected, true, true)
+	}
+	requests = append(requests, request{Headers: map[string]string{"x-github-event": "issue_comment"}, Body: map[string]interface{}{"action": "deleted"}})
+	expected = append(expected, false)
+
+	filter, err := az.GenerateFilterFunction(triggers)
+	require.NoError(t, err)
+	requestsJSON, err := json.Marshal(requests)
+	require.NoError(t, err)
+	out, err := exec.Command(node, "-e", filterHarness, filter, string(requestsJSON)).CombinedOutput()
+	require.NoError(t, err, string(out))
+	var matched []bool
+	require.NoError(t, json.Unmarshal(out, &matched), string(out))
+	assert.Equal(t, expected, matched)
+}
+
+func TestGenerateEntrypoint_SecretInputs(t *testing.T) {
+	secrets := append(jsInputs, randomJSInputs(10)...)
+	entrypoint, err := az.GenerateEntrypoint(secrets, flows.LoadedFlow{}, az.DeliveryPolicy{})
+	require.NoError(t, err)
 
+	// Every secret survives encoding, so deliveries signed with it are accepted:
+	var deliveries []delivery
+	var expected []int
+	for _, secret := range secrets {
+		if !utf8.ValidString(secret) {
+			// JSON replaces invalid UTF-8, like WEBHOOK_SECRET must be text.
+			continue
+		}
+		body := `{"zen":"Design for failure."}`
+		deliveries = append(deliveries, delivery{Headers: map[string]string{"x-github-event": "ping", "x-hub-signature-256": sign(secret, body)}, Body: body})
+		expected = append(expected, 200)
+	}
+	assert.Equal(t, expected, runEntrypoint(t, entrypoint, deliveries...))
 }
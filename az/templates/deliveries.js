@@ -0,0 +1,70 @@
+// Moves webhook deliveries through the queue.
+// Queue messages are limited to 64KB once base64 encoded, larger payloads are kept in a blob.
+const deliveryContainer = 'fsb-deliveries';
+const maxQueueMessage = 64 * 1024;
+
+// enqueueDelivery writes the delivery to the queue before returning, so failures can be handled.
+// Without storage, i.e. when run locally, the delivery is left to the host through the output binding.
+async function enqueueDelivery(context, req) {
+  const delivery = {
+    id: req.headers['x-github-delivery'] || crypto.randomBytes(8).toString('hex'),
+    event: req.headers['x-github-event'],
+    body: req.body
+  };
+  const storage = parseStorage(process.env.AzureWebJobsStorage);
+  if (!storage) {
+    if (!fitsQueue(delivery)) {
+      throw new Error('large deliveries require AzureWebJobsStorage');
+    }
+    context.bindings.delivery = delivery;
+    return delivery;
+  }
+
+  let message = delivery;
+  if (!fitsQueue(message)) {
+    const blob = '/' + deliveryContainer + '/' + delivery.id + '.json';
+    await storageRequest(storage, 'PUT', '/' + deliveryContainer, { restype: 'container' }, {});
+    const res = await storageRequest(storage, 'PUT', blob, {}, { 'x-ms-blob-type': 'BlockBlob' }, JSON.stringify(delivery.body));
+    if (res.status !== 201) {
+      throw new Error('storing delivery: ' + res.status + ' ' + res.body);
+    }
+    message = { id: delivery.id, event: delivery.event, blob };
+  }
+
+  // Like the output binding, messages are base64 encoded JSON:
+  const text = Buffer.from(JSON.stringify(message), 'utf8').toString('base64');
+  const xml = '<QueueMessage><MessageText>' + text + '</MessageText></QueueMessage>';
+  const send = () => queueRequest(storage, 'POST', '/' + deliveryQueue + '/messages', {}, { 'content-type': 'application/xml' }, xml);
+  let res = await send();
+  if (res.status === 404) {
+    await queueRequest(storage, 'PUT', '/' + deliveryQueue, {}, {});
+    res = await send();
+  }
+  if (res.status !== 201) {
+    throw new Error('queueing delivery: ' + res.status + ' ' + res.body);
+  }
+  return delivery;
+}
+
+// fitsQueue measures the encoded message in bytes, payloads are not ASCII.
+function fitsQueue(message) {
+  const size = Buffer.byteLength(JSON.stringify(message), 'utf8');
+  return Math.ceil(size / 3) * 4 <= maxQueueMessage;
+}
+
+async function loadDelivery(message) {
+  if (!message.blob) {
+    return message;
+  }
+  const res = await storageRequest(parseStorage(process.env.AzureWebJobsStorage), 'GET', message.blob, {}, {});
+  if (res.status !== 200) {
+    throw new Error('loading delivery: ' + res.status + ' ' + res.body);
+  }
+  return { id: message.id, event: message.event, body: JSON.parse(res.body) };
+}
+
+async function deleteDelivery(message) {
+  if (message.blob) {
+    await storageRequest(parseStorage(process.env.AzureWebJobsStorage), 'DELETE', message.blob, {}, {});
+  }
+}
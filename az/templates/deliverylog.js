@@ -0,0 +1,149 @@
+// Records delivery IDs in Table Storage. Tables have no TTL, so records carry their expiry:
+// expired records are replaced by redeliveries, and pruned by the cleanup function.
+const deliveryTable = 'fsbdeliveries';
+
+function deliveryEntityPath(id) {
+  return '/' + deliveryTable + "(PartitionKey='delivery',RowKey='" + encodeURIComponent(id.replace(/'/g, "''")) + "')";
+}
+
+// recordDelivery returns false if the delivery was already recorded and has not expired.
+async function recordDelivery(id) {
+  const storage = parseStorage(process.env.AzureWebJobsStorage);
+  if (!storage) {
+    throw new Error('de-duplicating deliveries requires AzureWebJobsStorage');
+  }
+  const entity = JSON.stringify({
+    PartitionKey: 'delivery',
+    RowKey: id,
+    ExpiresAt: new Date(Date.now() + deliveryPolicy.ttlSeconds * 1000).toISOString(),
+    'ExpiresAt@odata.type': 'Edm.DateTime'
+  });
+  const insert = () => tableRequest(storage, 'POST', '/' + deliveryTable, { prefer: 'return-no-content' }, entity);
+  let res = await insert();
+  if (res.status === 404) {
+    await tableRequest(storage, 'POST', '/Tables', { prefer: 'return-no-content' }, JSON.stringify({ TableName: deliveryTable }));
+    res = await insert();
+  }
+  if (res.status === 204) {
+    return true;
+  }
+  if (res.status !== 409) {
+    throw new Error('recording delivery: ' + res.status + ' ' + res.body);
+  }
+
+  const existing = await tableRequest(storage, 'GET', deliveryEntityPath(id), {});
+  if (existing.status === 200 && new Date(JSON.parse(existing.body).ExpiresAt) > new Date()) {
+    return false;
+  }
+  if (existing.status === 200) {
+    // Replace the expired record, unless a concurrent redelivery got there first:
+    res = await tableRequest(storage, 'PUT', deliveryEntityPath(id), { 'if-match': existing.headers.etag }, entity);
+    if (res.status !== 404) {
+      return res.status === 204;
+    }
+  }
+  // The record was pruned in between, insert it again:
+  res = await insert();
+  if (res.status !== 204 && res.status !== 409) {
+    throw new Error('recording delivery: ' + res.status + ' ' + res.body);
+  }
+  return res.status === 204;
+}
+
+// forgetDelivery removes a record, so GitHub's redelivery of a delivery that was not queued is run.
+async function forgetDelivery(id) {
+  const storage = parseStorage(process.env.AzureWebJobsStorage);
+  await tableRequest(storage, 'DELETE', deliveryEntityPath(id), { 'if-match': '*' });
+}
+
+// pruneDeliveries deletes expired records, returning how many.
+async function pruneDeliveries() {
+  const storage = parseStorage(process.env.AzureWebJobsStorage);
+  const filter = "ExpiresAt lt datetime'" + new Date().toISOString() + "'";
+  let pruned = 0;
+  let next = {};
+  do {
+    const query = Object.assign({ $filter: filter, $select: 'RowKey' }, next);
+    const res = await tableRequest(storage, 'GET', '/' + deliveryTable + '()', {}, '', query);
+    if (res.status === 404) {
+      return pruned;
+    }
+    if (res.status !== 200) {
+      throw new Error('listing deliveries: ' + res.status + ' ' + res.body);
+    }
+    for (const entity of JSON.parse(res.body).value) {
+      await tableRequest(storage, 'DELETE', deliveryEntityPath(entity.RowKey), { 'if-match': '*' });
+      pruned++;
+    }
+    next = {};
+    if (res.headers['x-ms-continuation-nextpartitionkey']) {
+      next.NextPartitionKey = res.headers['x-ms-continuation-nextpartitionkey'];
+      next.NextRowKey = res.headers['x-ms-continuation-nextrowkey'];
+    }
+  } while (next.NextPartitionKey);
+  return pruned;
+}
+
+// eventTime is when the event happened, payloads are not otherwise timestamped.
+// Only actions that update the subject's timestamp are timed: e.g. a deleted comment keeps the time of its last edit.
+// Pushes are timed by the push, their commits may have been written long before.
+function eventTime(event, body) {
+  const on = (...actions) => actions.includes(body.action);
+  switch (event) {
+    case 'push': {
+      const pushedAt = body.repository && body.repository.pushed_at;
+      return typeof pushedAt === 'number' ? new Date(pushedAt * 1000) : null;
+    }
+    case 'issue_comment':
+    case 'pull_request_review_comment':
+      return on('created', 'edited') ? parseTime(body.comment && body.comment.updated_at) : null;
+    case 'pull_request_review':
+      return on('submitted') ? parseTime(body.review && body.review.submitted_at) : null;
+    case 'pull_request':
+    case 'pull_request_target':
+      return on('opened', 'edited', 'reopened', 'synchronize', 'closed') ? parseTime(body.pull_request && body.pull_request.updated_at) : null;
+    case 'issues':
+      return on('opened', 'edited', 'reopened', 'closed') ? parseTime(body.issue && body.issue.updated_at) : null;
+  }
+  return null;
+}
+
+function parseTime(v) {
+  const t = new Date(v);
+  return v && !isNaN(t) ? t : null;
+}
+
+function isStale(event, body) {
+  if (!(deliveryPolicy.maxAgeSeconds > 0)) {
+    return false;
+  }
+  const t = eventTime(event, body || {});
+  return t !== null && Date.now() - t.getTime() > deliveryPolicy.maxAgeSeconds * 1000;
+}
+
+// tableRequest calls the Table service REST API, authorized with the account's shared key.
+function tableRequest(storage, method, resource, headers, body, query) {
+  const url = new URL(storage.tableEndpoint + resource);
+  Object.keys(query || {}).forEach((k) => url.searchParams.set(k, query[k]));
+  const data = Buffer.from(body || '');
+  const h = Object.assign({
+    'x-ms-date': new Date().toUTCString(),
+    'x-ms-version': '2019-02-02',
+    'dataserviceversion': '3.0;NetFx',
+    'accept': 'application/json;odata=nometadata',
+    'content-length': String(data.length)
+  }, data.length > 0 ? { 'content-type': 'application/json' } : {}, headers);
+  const stringToSign = [method, '', h['content-type'] || '', h['x-ms-date'], '/' + storage.account + url.pathname].join('\n');
+  const signature = crypto.createHmac('sha256', Buffer.from(storage.key, 'base64')).update(stringToSign, 'utf8').digest('base64');
+  h.authorization = 'SharedKey ' + storage.account + ':' + signature;
+
+  return new Promise((resolve, reject) => {
+    const req = (url.protocol === 'http:' ? http : https).request(url, { method, headers: h }, (res) => {
+      const chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('end', () => resolve({ status: res.statusCode, headers: res.headers, body: Buffer.concat(chunks).toString() }));
+    });
+    req.on('error', reject);
+    req.end(data);
+  });
+}
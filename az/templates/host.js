@@ -0,0 +1,116 @@
+// A minimal Azure Functions host: requests are sent to the HTTP function, and what it queues to the queue functions.
+// Usage: node host.js <app dir> <requests.json> <responses.json>
+// Logs are printed as they happen, steps print to stdout.
+// With AzureWebJobsStorage, its Queue service is replaced by one in this process; blobs and tables are used as is.
+const fs = require('fs');
+const http = require('http');
+const path = require('path');
+
+const [appDir, requestsFile, responsesFile] = process.argv.slice(2);
+const host = JSON.parse(fs.readFileSync(path.join(appDir, 'host.json'), 'utf8'));
+const functions = fs.readdirSync(appDir)
+  .filter((name) => fs.existsSync(path.join(appDir, name, 'function.json')))
+  .map((name) => ({
+    name,
+    bindings: JSON.parse(fs.readFileSync(path.join(appDir, name, 'function.json'), 'utf8')).bindings,
+    main: require(path.join(appDir, name, 'index.js'))
+  }));
+
+function triggered(type, queueName) {
+  return functions.find((fn) => fn.bindings.some((b) => b.direction === 'in' && b.type === type &&
+    (queueName === undefined || b.queueName === queueName)));
+}
+
+function newContext(fn, logs, bindingData) {
+  const log = (...args) => {
+    const line = fn.name + ': ' + args.join(' ');
+    logs.push(line);
+    process.stderr.write(line + '\n');
+  };
+  log.error = log;
+  log.warn = log;
+  log.info = log;
+  return { log, bindings: {}, bindingData: bindingData || {} };
+}
+
+// deliver retries a queue message like the host, before moving it to the poison queue.
+async function deliver(queueName, message, logs) {
+  const fn = triggered('queueTrigger', queueName);
+  for (let dequeueCount = 1; dequeueCount <= host.extensions.queues.maxDequeueCount; dequeueCount++) {
+    try {
+      await fn.main(newContext(fn, logs, { dequeueCount }), JSON.parse(JSON.stringify(message)));
+      return;
+    } catch (err) {
+      const line = fn.name + ': ' + err.message;
+      logs.push(line);
+      process.stderr.write(line + '\n');
+    }
+  }
+  const poison = triggered('queueTrigger', queueName + '-poison');
+  await poison.main(newContext(poison, logs), message);
+}
+
+// queueService accepts messages like the Queue REST API, without checking their signature.
+function queueService(queued) {
+  const server = http.createServer((req, res) => {
+    const chunks = [];
+    req.on('data', (chunk) => chunks.push(chunk));
+    req.on('end', () => {
+      const match = new URL(req.url, 'http://localhost').pathname.match(/^\/[^/]+\/([^/]+)\/messages$/);
+      if (req.method === 'POST' && match) {
+        const text = Buffer.concat(chunks).toString().match(/<MessageText>(.*)<\/MessageText>/)[1];
+        queued.push({ queueName: match[1], message: JSON.parse(Buffer.from(text, 'base64').toString('utf8')) });
+        res.writeHead(201);
+      } else {
+        res.writeHead(req.method === 'PUT' ? 201 : 404);
+      }
+      res.end();
+    });
+  });
+  return new Promise((resolve) => server.listen(0, '127.0.0.1', () => resolve(server)));
+}
+
+(async () => {
+  const queued = [];
+  if (process.env.AzureWebJobsStorage) {
+    const server = await queueService(queued);
+    const account = (process.env.AzureWebJobsStorage.match(/AccountName=([^;]+)/) || [])[1] || 'devstoreaccount1';
+    process.env.AzureWebJobsStorage += ';QueueEndpoint=http://127.0.0.1:' + server.address().port + '/' + account;
+    server.unref();
+  }
+
+  const responses = [];
+  for (const req of JSON.parse(fs.readFileSync(requestsFile, 'utf8'))) {
+    const fn = triggered('httpTrigger');
+    const logs = [];
+    const context = newContext(fn, logs);
+    let body;
+    try {
+      body = JSON.parse(req.body);
+    } catch (err) {
+      body = req.body;
+    }
+    try {
+      await fn.main(context, { method: 'POST', headers: req.headers, rawBody: req.body, body });
+    } catch (err) {
+      context.log(err.message);
+      context.res = { status: 500, body: 'Internal Server Error' };
+      context.bindings = {};
+    }
+    for (const b of fn.bindings) {
+      if (b.direction === 'out' && b.type === 'queue' && context.bindings[b.name] !== undefined) {
+        queued.push({ queueName: b.queueName, message: context.bindings[b.name] });
+      }
+    }
+    for (const { queueName, message } of queued.splice(0)) {
+      await deliver(queueName, message, logs);
+    }
+    responses.push({ status: context.res.status, body: context.res.body, logs });
+  }
+  fs.writeFileSync(responsesFile, JSON.stringify(responses));
+  // Kept-alive storage connections would hold the process open:
+  process.exit(0);
+})().catch((err) => {
+  console.error(err);
+  process.exit(1);
+});
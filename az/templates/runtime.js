@@ -0,0 +1,240 @@
+// Executes the plan: each step is a child process, so instances of a job run in parallel with their own environment.
+// Scopes nest (run, job, instance) so cancelling one kills the steps running beneath it.
+function newScope(parent, env) {
+  return { parent, env: parent ? parent.env : env, cancelled: false, children: new Set() };
+}
+
+function isCancelled(scope) {
+  for (let s = scope; s; s = s.parent) {
+    if (s.cancelled) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function cancel(scope) {
+  scope.cancelled = true;
+  scope.children.forEach((child) => child.kill());
+}
+
+function runStep(step, scope) {
+  return new Promise((resolve) => {
+    const child = fork(path.join(__dirname, '..', step.main), [], {
+      env: Object.assign({}, process.env, scope.env, step.env)
+    });
+    for (let s = scope; s; s = s.parent) {
+      s.children.add(child);
+    }
+    let timedOut = false;
+    const timer = step.timeoutMinutes > 0 ? setTimeout(() => {
+      timedOut = true;
+      child.kill();
+    }, step.timeoutMinutes * 60 * 1000) : null;
+    const done = (code) => {
+      clearTimeout(timer);
+      for (let s = scope; s; s = s.parent) {
+        s.children.delete(child);
+      }
+      resolve({ code, timedOut });
+    };
+    child.on('error', () => done(1));
+    child.on('exit', (code) => done(code === null ? 1 : code));
+  });
+}
+
+async function runInstance(context, instance, scope) {
+  const result = { name: instance.name, conclusion: 'success', steps: [] };
+  const timer = instance.timeoutMinutes > 0 ? setTimeout(() => {
+    context.log(instance.name + ': timed out after ' + instance.timeoutMinutes + ' minutes');
+    cancel(scope);
+  }, instance.timeoutMinutes * 60 * 1000) : null;
+  try {
+    for (const step of instance.steps) {
+      if (isCancelled(scope)) {
+        result.conclusion = 'cancelled';
+        break;
+      }
+      const { code, timedOut } = await runStep(step, scope);
+      let outcome = code === 0 ? 'success' : 'failure';
+      if (isCancelled(scope) && !timedOut && code !== 0) {
+        outcome = 'cancelled';
+      }
+      const conclusion = outcome === 'failure' && step.continueOnError ? 'success' : outcome;
+      result.steps.push({ name: step.name, outcome, conclusion });
+      if (outcome !== 'success') {
+        context.log(instance.name + ': ' + step.name + ' ' + (timedOut ? 'timed out' : outcome + ' with ' + code));
+      }
+      if (conclusion !== 'success') {
+        result.conclusion = conclusion;
+        break;
+      }
+    }
+  } finally {
+    clearTimeout(timer);
+  }
+  return result;
+}
+
+async function runJob(context, github, job, runScope) {
+  const scope = newScope(runScope);
+  const pending = job.instances.slice();
+  const results = [];
+  let ok = true;
+  const worker = async () => {
+    while (pending.length > 0 && !isCancelled(scope)) {
+      const instance = pending.shift();
+      const instanceScope = newScope(scope);
+      const result = await withConcurrency(context, github, instance.concurrency, instanceScope,
+        () => runInstance(context, instance, instanceScope)) ||
+        { name: instance.name, conclusion: 'cancelled', steps: [] };
+      results.push(result);
+      if (result.conclusion !== 'success' && !instance.continueOnError) {
+        ok = false;
+        if (job.failFast) {
+          cancel(scope);
+        }
+      }
+    }
+  };
+  let parallel = job.instances.length;
+  if (job.maxParallel > 0 && job.maxParallel < parallel) {
+    parallel = job.maxParallel;
+  }
+  const workers = [];
+  for (let i = 0; i < parallel; i++) {
+    workers.push(worker());
+  }
+  await Promise.all(workers);
+  for (const instance of pending) {
+    results.push({ name: instance.name, conclusion: 'cancelled', steps: [] });
+  }
+  return { name: job.name, ok, instances: results };
+}
+
+async function runWorkflow(context, github, env) {
+  const scope = newScope(null, env);
+  const result = await withConcurrency(context, github, plan.concurrency, scope, async () => {
+    const jobs = [];
+    for (const job of plan.jobs) {
+      jobs.push(await runJob(context, github, job, scope));
+    }
+    if (isCancelled(scope)) {
+      return { conclusion: 'cancelled', jobs };
+    }
+    const ok = jobs.every((job) => job.ok);
+    return { conclusion: ok ? 'success' : 'failure', jobs };
+  });
+  return result || { conclusion: 'cancelled', jobs: [] };
+}
+
+// githubContext resolves the `github.*` expressions of concurrency groups.
+function githubContext(delivery) {
+  const body = delivery.body || {};
+  const pr = body.pull_request;
+  return {
+    workflow: plan.workflow,
+    event_name: delivery.event,
+    event: body,
+    repository: body.repository ? body.repository.full_name : '',
+    ref: body.ref || (pr ? 'refs/pull/' + pr.number + '/merge' : ''),
+    head_ref: pr ? pr.head.ref : '',
+    run_id: delivery.id
+  };
+}
+
+function interpolate(v, github) {
+  return v.replace(/\$\{\{\s*github\.([\w.-]+)\s*\}\}/g, (_, expr) => {
+    let value = github;
+    for (const key of expr.split('.')) {
+      value = value === undefined || value === null ? undefined : value[key];
+    }
+    return value === undefined || value === null ? '' : String(value);
+  });
+}
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+const leaseContainer = 'fsb-concurrency';
+const leaseSeconds = 60;
+
+// withConcurrency runs fn holding the group's blob lease, like Actions' `concurrency:`.
+// Of the runs waiting for a group only the newest is kept, the others are cancelled and return null.
+// The wait counts against the functionTimeout, so runs that wait longer than plan.concurrencyWaitSeconds are cancelled too.
+// With cancelInProgress, the running holder cancels itself once a newer run is waiting.
+async function withConcurrency(context, github, concurrency, scope, fn) {
+  if (!concurrency) {
+    return fn();
+  }
+  const storage = parseStorage(process.env.AzureWebJobsStorage);
+  if (!storage) {
+    throw new Error('concurrency groups require AzureWebJobsStorage');
+  }
+  const group = interpolate(concurrency.group, github);
+  const blob = leaseContainer + '/' + crypto.createHash('sha256').update(group).digest('hex');
+  const id = github.run_id + '/' + crypto.randomBytes(8).toString('hex');
+
+  await storageRequest(storage, 'PUT', '/' + leaseContainer, { restype: 'container' }, {});
+  await storageRequest(storage, 'PUT', '/' + blob + '.pending', {}, { 'x-ms-blob-type': 'BlockBlob' }, id);
+  const pending = async () => (await storageRequest(storage, 'GET', '/' + blob + '.pending', {}, {})).body;
+
+  const deadline = Date.now() + plan.concurrencyWaitSeconds * 1000;
+  let lease = await acquireLease(storage, blob);
+  while (!lease) {
+    await sleep(5000);
+    if (isCancelled(scope) || (await pending()) !== id) {
+      context.log('concurrency group ' + group + ': cancelled by a newer run');
+      return null;
+    }
+    if (Date.now() >= deadline) {
+      context.log('concurrency group ' + group + ': cancelled after waiting ' + plan.concurrencyWaitSeconds + 's');
+      return null;
+    }
+    lease = await acquireLease(storage, blob);
+  }
+  context.log('concurrency group ' + group + ': acquired');
+
+  const renew = setInterval(async () => {
+    try {
+      await storageRequest(storage, 'PUT', '/' + blob, { comp: 'lease' }, {
+        'x-ms-lease-action': 'renew',
+        'x-ms-lease-id': lease
+      });
+      if (concurrency.cancelInProgress && (await pending()) !== id) {
+        context.log('concurrency group ' + group + ': cancelling in progress run');
+        cancel(scope);
+      }
+    } catch (err) {
+      context.log('concurrency group ' + group + ': ' + err);
+    }
+  }, leaseSeconds * 1000 / 3);
+  try {
+    return await fn();
+  } finally {
+    clearInterval(renew);
+    await storageRequest(storage, 'PUT', '/' + blob, { comp: 'lease' }, {
+      'x-ms-lease-action': 'release',
+      'x-ms-lease-id': lease
+    });
+  }
+}
+
+async function acquireLease(storage, blob) {
+  const id = crypto.randomBytes(16).toString('hex').replace(/(.{8})(.{4})(.{4})(.{4})(.{12})/, '$1-$2-$3-$4-$5');
+  const acquire = () => storageRequest(storage, 'PUT', '/' + blob, { comp: 'lease' }, {
+    'x-ms-lease-action': 'acquire',
+    'x-ms-lease-duration': String(leaseSeconds),
+    'x-ms-proposed-lease-id': id
+  });
+  let res = await acquire();
+  if (res.status === 404) {
+    await storageRequest(storage, 'PUT', '/' + blob, {}, { 'x-ms-blob-type': 'BlockBlob', 'if-none-match': '*' });
+    res = await acquire();
+  }
+  if (res.status === 201) {
+    return id;
+  }
+  if (res.status === 409) {
+    return null;
+  }
+  throw new Error('acquiring lease: ' + res.status + ' ' + res.body);
+}
@@ -0,0 +1,21 @@
+// Implements the SenderPolicy of deliveryPolicy, returning why an event is ignored.
+function ignoredSender(body) {
+  const sender = (body && body.sender) || {};
+  const login = String(sender.login || '').toLowerCase();
+  if (deliveryPolicy.logins.some((l) => l.toLowerCase() === login)) {
+    return 'sender ' + sender.login;
+  }
+  if (deliveryPolicy.bots && sender.type === 'Bot') {
+    return 'bot ' + sender.login;
+  }
+  if (deliveryPolicy.appId > 0) {
+    for (const key of Object.keys(body || {})) {
+      const subject = body[key];
+      const app = subject && (subject.performed_via_github_app || subject.app);
+      if (app && app.id === deliveryPolicy.appId) {
+        return 'app ' + app.slug;
+      }
+    }
+  }
+  return null;
+}
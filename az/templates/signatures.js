@@ -0,0 +1,15 @@
+// Verifies X-Hub-Signature-256 against the raw body, as re-serializing the parsed body may change it.
+// Every secret is compared in constant time, so responses don't reveal which one matched.
+function verifySignature(rawBody, header) {
+  const match = /^sha256=([0-9a-f]{64})$/.exec(header || '');
+  if (!match) {
+    return false;
+  }
+  const signature = Buffer.from(match[1], 'hex');
+  let ok = false;
+  for (const secret of secrets) {
+    const expected = crypto.createHmac('sha256', secret).update(rawBody || '', 'utf8').digest();
+    ok = crypto.timingSafeEqual(expected, signature) || ok;
+  }
+  return ok;
+}
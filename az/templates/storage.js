@@ -0,0 +1,80 @@
+// Calls the Blob and Queue services of the function's storage account, for concurrency leases and queued deliveries.
+function parseStorage(connectionString) {
+  if (!connectionString) {
+    return null;
+  }
+  const parts = {};
+  for (const part of connectionString.split(';')) {
+    const i = part.indexOf('=');
+    if (i > 0) {
+      parts[part.slice(0, i)] = part.slice(i + 1);
+    }
+  }
+  // Endpoints given in the connection string take precedence, e.g. Azurite on other ports:
+  let storage;
+  if (parts.UseDevelopmentStorage === 'true') {
+    storage = {
+      account: 'devstoreaccount1',
+      key: 'Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==',
+      endpoint: 'http://127.0.0.1:10000/devstoreaccount1',
+      queueEndpoint: 'http://127.0.0.1:10001/devstoreaccount1',
+      tableEndpoint: 'http://127.0.0.1:10002/devstoreaccount1'
+    };
+  } else {
+    const serviceEndpoint = (service) => (parts.DefaultEndpointsProtocol || 'https') + '://' + parts.AccountName + '.' +
+      service + '.' + (parts.EndpointSuffix || 'core.windows.net');
+    storage = {
+      account: parts.AccountName,
+      key: parts.AccountKey,
+      endpoint: serviceEndpoint('blob'),
+      queueEndpoint: serviceEndpoint('queue'),
+      tableEndpoint: serviceEndpoint('table')
+    };
+  }
+  storage.endpoint = (parts.BlobEndpoint || storage.endpoint).replace(/\/$/, '');
+  storage.queueEndpoint = (parts.QueueEndpoint || storage.queueEndpoint).replace(/\/$/, '');
+  storage.tableEndpoint = (parts.TableEndpoint || storage.tableEndpoint).replace(/\/$/, '');
+  return storage;
+}
+
+// storageRequest calls the Blob service REST API, authorized with the account's shared key.
+function storageRequest(storage, method, resource, query, headers, body) {
+  return sharedKeyRequest(storage, storage.endpoint, method, resource, query, headers, body);
+}
+
+// queueRequest calls the Queue service REST API, which is signed like the Blob service.
+function queueRequest(storage, method, resource, query, headers, body) {
+  return sharedKeyRequest(storage, storage.queueEndpoint, method, resource, query, headers, body);
+}
+
+function sharedKeyRequest(storage, endpoint, method, resource, query, headers, body) {
+  const url = new URL(endpoint + resource);
+  Object.keys(query).forEach((k) => url.searchParams.set(k, query[k]));
+  const data = Buffer.from(body || '');
+  const h = Object.assign({
+    'x-ms-date': new Date().toUTCString(),
+    'x-ms-version': '2019-12-12',
+    'content-length': String(data.length)
+  }, headers);
+
+  const canonicalHeaders = Object.keys(h).filter((k) => k.startsWith('x-ms-')).sort()
+    .map((k) => k + ':' + h[k] + '\n').join('');
+  const canonicalResource = '/' + storage.account + url.pathname +
+    Object.keys(query).sort().map((k) => '\n' + k + ':' + query[k]).join('');
+  const stringToSign = [
+    method, '', '', data.length > 0 ? String(data.length) : '', '', '', '', '',
+    h['if-match'] || '', h['if-none-match'] || '', '', ''
+  ].join('\n') + '\n' + canonicalHeaders + canonicalResource;
+  const signature = crypto.createHmac('sha256', Buffer.from(storage.key, 'base64')).update(stringToSign, 'utf8').digest('base64');
+  h.authorization = 'SharedKey ' + storage.account + ':' + signature;
+
+  return new Promise((resolve, reject) => {
+    const req = (url.protocol === 'http:' ? http : https).request(url, { method, headers: h }, (res) => {
+      const chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('end', () => resolve({ status: res.statusCode, body: Buffer.concat(chunks).toString() }));
+    });
+    req.on('error', reject);
+    req.end(data);
+  });
+}
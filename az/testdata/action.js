@@ -0,0 +1,15 @@
+// A fake action, recording the environment it runs in.
+// FSB_ACTION_SLEEP delays it by milliseconds and FSB_ACTION_EXIT sets its exit code, to test the runtime.
+const fs = require('fs');
+
+setTimeout(() => {
+  const env = {};
+  for (const [k, v] of Object.entries(process.env)) {
+    if (k.startsWith('INPUT_') || k === 'GREETING') {
+      env[k] = v;
+    }
+  }
+  const event = JSON.parse(fs.readFileSync(process.env.GITHUB_EVENT_PATH, 'utf8'));
+  fs.appendFileSync(process.env.FSB_ACTION_LOG, JSON.stringify({ env, event }) + '\n');
+  process.exitCode = Number(process.env.FSB_ACTION_EXIT || 0);
+}, Number(process.env.FSB_ACTION_SLEEP || 0));
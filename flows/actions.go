@@ -0,0 +1,268 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v30/github"
+	"gopkg.in/yaml.v2"
+)
+
+// ActionSource provides action metadata and code.
+type ActionSource interface {
+	// Resolve pins a reference to a commit SHA.
+	Resolve(ctx context.Context, ref ActionReference) (string, error)
+	// Fetch returns the action at a commit SHA, including its files if FunctionCompatible.
+	Fetch(ctx context.Context, ref ActionReference, sha string) (Action, error)
+}
+
+// refVerifier is an ActionSource that can check the signatures of refs.
+type refVerifier interface {
+	Verify(ctx context.Context, ref ActionReference, sha string) error
+}
+
+// ErrCacheMiss is returned by an offline cache for actions it does not contain.
+var ErrCacheMiss = errors.New("action not in cache")
+
+type gitHubActionSource struct {
+	gh *github.Client
+}
+
+// NewGitHubActionSource fetches actions live through the GitHub API.
+func NewGitHubActionSource(gh *github.Client) ActionSource {
+	return &gitHubActionSource{gh: gh}
+}
+
+func (s *gitHubActionSource) Resolve(ctx context.Context, ref ActionReference) (string, error) {
+	sha, _, err := s.gh.Repositories.GetCommitSHA1(ctx, ref.RepoOwner, ref.RepoName, ref.Ref, "")
+	return sha, err
+}
+
+func (s *gitHubActionSource) Verify(ctx context.Context, ref ActionReference, sha string) error {
+	return verifyRef(ctx, s.gh, ref, sha)
+}
+
+func (s *gitHubActionSource) Fetch(ctx context.Context, ref ActionReference, sha string) (Action, error) {
+	contentsResp, _, _, err := s.gh.Repositories.GetContents(ctx, ref.RepoOwner, ref.RepoName, actionsMetadataFile, &github.RepositoryContentGetOptions{Ref: sha})
+	if err != nil {
+		return Action{}, fmt.Errorf("fetching action metadata: %w", err)
+	}
+	contents, err := contentsResp.GetContent()
+	if err != nil {
+		return Action{}, fmt.Errorf("decoding action metadata contents: %w", err)
+	}
+	var action Action
+	if err := yaml.Unmarshal([]byte(contents), &action); err != nil {
+		return Action{}, fmt.Errorf("decoding action metadata: %w", err)
+	}
+	action.SHA = sha
+
+	if action.FunctionCompatible() {
+		files, err := s.fetchFiles(ctx, ref, sha, path.Dir(action.Runs.Main))
+		if err != nil {
+			return Action{}, err
+		}
+		if _, ok := files[action.Runs.Main]; !ok {
+			return Action{}, fmt.Errorf("action main %q not found", action.Runs.Main)
+		}
+		action.Files = files
+	}
+	return action, nil
+}
+
+// fetchFiles downloads every file beneath a directory of the action repository.
+func (s *gitHubActionSource) fetchFiles(ctx context.Context, ref ActionReference, sha, dir string) (map[string][]byte, error) {
+	tree, _, err := s.gh.Git.GetTree(ctx, ref.RepoOwner, ref.RepoName, sha, true)
+	if err != nil {
+		return nil, fmt.Errorf("fetching action tree: %w", err)
+	}
+	if tree.GetTruncated() {
+		return nil, fmt.Errorf("action tree is truncated")
+	}
+
+	files := map[string][]byte{}
+	prefix := dir + "/"
+	for _, entry := range tree.Entries {
+		if entry.GetType() != "blob" || !strings.HasPrefix(entry.GetPath(), prefix) {
+			continue
+		}
+		blob, _, err := s.gh.Git.GetBlobRaw(ctx, ref.RepoOwner, ref.RepoName, entry.GetSHA())
+		if err != nil {
+			return nil, fmt.Errorf("fetching action file %q: %w", entry.GetPath(), err)
+		}
+		files[entry.GetPath()] = blob
+	}
+	return files, nil
+}
+
+// fallbackActionSource tries a primary source, then a fallback for actions the primary doesn't have.
+type fallbackActionSource struct {
+	primary  ActionSource
+	fallback ActionSource
+}
+
+// NewFallbackActionSource uses fallback for actions that are not found in primary.
+func NewFallbackActionSource(primary, fallback ActionSource) ActionSource {
+	return &fallbackActionSource{primary: primary, fallback: fallback}
+}
+
+func (s *fallbackActionSource) Resolve(ctx context.Context, ref ActionReference) (string, error) {
+	sha, err := s.primary.Resolve(ctx, ref)
+	if isNotFound(err) {
+		return s.fallback.Resolve(ctx, ref)
+	}
+	return sha, err
+}
+
+func (s *fallbackActionSource) Verify(ctx context.Context, ref ActionReference, sha string) error {
+	primary, ok := s.primary.(refVerifier)
+	if !ok {
+		return fmt.Errorf("%w: action source can not verify refs", ErrActionNotAllowed)
+	}
+	err := primary.Verify(ctx, ref, sha)
+	if fallback, ok := s.fallback.(refVerifier); ok && isNotFound(err) {
+		return fallback.Verify(ctx, ref, sha)
+	}
+	return err
+}
+
+func (s *fallbackActionSource) Fetch(ctx context.Context, ref ActionReference, sha string) (Action, error) {
+	action, err := s.primary.Fetch(ctx, ref, sha)
+	if isNotFound(err) {
+		return s.fallback.Fetch(ctx, ref, sha)
+	}
+	return action, err
+}
+
+// isNotFound returns true if the error is a 404 from the GitHub API.
+func isNotFound(err error) bool {
+	var errResp *github.ErrorResponse
+	return errors.As(err, &errResp) && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound
+}
+
+// cacheActionSource stores actions on disk, content-addressed by owner/repo/SHA.
+type cacheActionSource struct {
+	dir      string
+	upstream ActionSource
+}
+
+// NewCacheActionSource caches actions from upstream in a directory.
+// If upstream is nil, the cache is offline and fails fast with ErrCacheMiss.
+func NewCacheActionSource(dir string, upstream ActionSource) ActionSource {
+	return &cacheActionSource{dir: dir, upstream: upstream}
+}
+
+func (s *cacheActionSource) Resolve(ctx context.Context, ref ActionReference) (string, error) {
+	if s.upstream == nil {
+		return "", fmt.Errorf("%w: can not resolve %s/%s@%s offline, pin it in the lockfile", ErrCacheMiss, ref.RepoOwner, ref.RepoName, ref.Ref)
+	}
+	return s.upstream.Resolve(ctx, ref)
+}
+
+func (s *cacheActionSource) Verify(ctx context.Context, ref ActionReference, sha string) error {
+	verifier, ok := s.upstream.(refVerifier)
+	if !ok {
+		return fmt.Errorf("can not verify %s/%s@%s offline", ref.RepoOwner, ref.RepoName, ref.Ref)
+	}
+	return verifier.Verify(ctx, ref, sha)
+}
+
+func (s *cacheActionSource) Fetch(ctx context.Context, ref ActionReference, sha string) (Action, error) {
+	dir := filepath.Join(s.dir, ref.RepoOwner, ref.RepoName, sha)
+	action, err := readCachedAction(dir)
+	if err == nil {
+		action.SHA = sha
+		return action, nil
+	} else if !os.IsNotExist(err) {
+		return Action{}, fmt.Errorf("reading cached action: %w", err)
+	}
+
+	if s.upstream == nil {
+		return Action{}, fmt.Errorf("%w: %s/%s@%s", ErrCacheMiss, ref.RepoOwner, ref.RepoName, sha)
+	}
+	action, err = s.upstream.Fetch(ctx, ref, sha)
+	if err != nil {
+		return Action{}, err
+	}
+	if err := writeCachedAction(dir, action); err != nil {
+		return Action{}, fmt.Errorf("caching action: %w", err)
+	}
+	return action, nil
+}
+
+func readCachedAction(dir string) (Action, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, actionsMetadataFile))
+	if err != nil {
+		return Action{}, err
+	}
+	var action Action
+	if err := yaml.Unmarshal(b, &action); err != nil {
+		return Action{}, fmt.Errorf("decoding action metadata: %w", err)
+	}
+	if !action.FunctionCompatible() {
+		return action, nil
+	}
+
+	action.Files = map[string][]byte{}
+	filesDir := filepath.Join(dir, filepath.FromSlash(path.Dir(action.Runs.Main)))
+	err = filepath.Walk(filesDir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		action.Files[filepath.ToSlash(rel)] = contents
+		return nil
+	})
+	if err != nil {
+		return Action{}, err
+	}
+	return action, nil
+}
+
+// writeCachedAction populates a temporary directory, then moves it into place so readers never see partial actions.
+func writeCachedAction(dir string, action Action) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	metadata, err := yaml.Marshal(action)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, actionsMetadataFile), metadata, 0644); err != nil {
+		return err
+	}
+	for p, contents := range action.Files {
+		fn := filepath.Join(tmp, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fn, contents, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package flows_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/v30/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+const echoTimerSHA = "0123456789abcdef0123456789abcdef01234567"
+
+// fakeActionSource serves actions from memory, by "owner/name".
+type fakeActionSource struct {
+	actions map[string]flows.Action
+
+	mu      sync.Mutex
+	fetches int
+}
+
+var errNotFound = &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+
+func newFakeActionSource() *fakeActionSource {
+	return &fakeActionSource{actions: map[string]flows.Action{
+		"thepwagner/echo-timer": {
+			Name: "Echo Timer",
+			Inputs: map[string]flows.ActionInput{
+				"id":    {Required: true},
+				"token": {Default: "${{ github.token }}"},
+			},
+			Outputs: map[string]flows.ActionOutput{"reply-id": {}},
+			Runs:    flows.Runs{Using: "node12", Main: "dist/index.js"},
+			Files: map[string][]byte{
+				"dist/index.js":    []byte("require('./37.index.js');"),
+				"dist/37.index.js": []byte("console.log('hi');"),
+			},
+		},
+		"actions/labeler": {
+			Runs: flows.Runs{Using: "node12", Main: "lib/main.js"},
+		},
+	}}
+}
+
+func (f *fakeActionSource) Resolve(_ context.Context, ref flows.ActionReference) (string, error) {
+	if _, ok := f.actions[ref.RepoOwner+"/"+ref.RepoName]; !ok {
+		return "", errNotFound
+	}
+	return echoTimerSHA, nil
+}
+
+func (f *fakeActionSource) Fetch(_ context.Context, ref flows.ActionReference, sha string) (flows.Action, error) {
+	f.mu.Lock()
+	f.fetches++
+	f.mu.Unlock()
+	action, ok := f.actions[ref.RepoOwner+"/"+ref.RepoName]
+	if !ok {
+		return flows.Action{}, fmt.Errorf("fetching action metadata: %w", errNotFound)
+	}
+	action.SHA = sha
+	return action, nil
+}
+
+func TestCacheActionSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	ref := flows.ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"}
+
+	// Offline caches fail fast:
+	offline := flows.NewCacheActionSource(dir, nil)
+	_, err = offline.Fetch(ctx, ref, echoTimerSHA)
+	assert.True(t, errors.Is(err, flows.ErrCacheMiss))
+	_, err = offline.Resolve(ctx, ref)
+	assert.True(t, errors.Is(err, flows.ErrCacheMiss))
+
+	// Populate the cache:
+	upstream := newFakeActionSource()
+	cache := flows.NewCacheActionSource(dir, upstream)
+	fetched, err := cache.Fetch(ctx, ref, echoTimerSHA)
+	require.NoError(t, err)
+	assert.Equal(t, 1, upstream.fetches)
+	assert.FileExists(t, fmt.Sprintf("%s/thepwagner/echo-timer/%s/dist/37.index.js", dir, echoTimerSHA))
+
+	for _, src := range []flows.ActionSource{cache, offline} {
+		cached, err := src.Fetch(ctx, ref, echoTimerSHA)
+		require.NoError(t, err)
+		assert.Equal(t, fetched, cached)
+		assert.Equal(t, fetched.ContentHash(), cached.ContentHash())
+	}
+	assert.Equal(t, 1, upstream.fetches)
+}
+
+func TestFallbackActionSource(t *testing.T) {
+	ctx := context.Background()
+	echoTimer := flows.ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"}
+	labeler := flows.ActionReference{RepoOwner: "actions", RepoName: "labeler", Ref: "v2"}
+
+	primary := newFakeActionSource()
+	delete(primary.actions, "thepwagner/echo-timer")
+	primary.actions["actions/labeler"] = flows.Action{Name: "Enterprise Labeler"}
+	fallback := newFakeActionSource()
+	src := flows.NewFallbackActionSource(primary, fallback)
+
+	// Found in primary:
+	sha, err := src.Resolve(ctx, labeler)
+	require.NoError(t, err)
+	action, err := src.Fetch(ctx, labeler, sha)
+	require.NoError(t, err)
+	assert.Equal(t, "Enterprise Labeler", action.Name)
+
+	// Missing from primary:
+	sha, err = src.Resolve(ctx, echoTimer)
+	require.NoError(t, err)
+	action, err = src.Fetch(ctx, echoTimer, sha)
+	require.NoError(t, err)
+	assert.Equal(t, "Echo Timer", action.Name)
+
+	// Missing from both:
+	_, err = src.Resolve(ctx, flows.ActionReference{RepoOwner: "nope", RepoName: "nope", Ref: "v1"})
+	assert.Error(t, err)
+}
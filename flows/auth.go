@@ -0,0 +1,49 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// hostTokenTransport authenticates requests with per-host credentials.
+// Requests to other hosts are sent without credentials.
+type hostTokenTransport struct {
+	base  http.RoundTripper
+	hosts map[string]http.RoundTripper
+}
+
+func newHostTokenTransport(base http.RoundTripper, tokens map[string]string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &hostTokenTransport{
+		base:  base,
+		hosts: make(map[string]http.RoundTripper, len(tokens)),
+	}
+	for host, token := range tokens {
+		t.hosts[host] = &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+			Base:   base,
+		}
+	}
+	return t
+}
+
+func (t *hostTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.hosts[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// TokenLogin returns the login of the token's user. GitHub App installation tokens have no user.
+func (l *Loader) TokenLogin(ctx context.Context) (string, error) {
+	user, _, err := l.gh.Users.Get(ctx, "")
+	if err != nil {
+		return "", fmt.Errorf("getting authenticated user: %w", err)
+	}
+	return user.GetLogin(), nil
+}
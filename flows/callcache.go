@@ -0,0 +1,100 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// callCache memoizes calls by key. Concurrent callers for the same key share a single call,
+// like golang.org/x/sync/singleflight, but successful results are kept.
+type callCache struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	// waiters share the call, it is cancelled once they and the caller running it gave up.
+	waiters int
+	gaveUp  bool
+	cancel  context.CancelFunc
+}
+
+var errCallPanicked = errors.New("shared call panicked")
+
+func newCallCache() *callCache {
+	return &callCache{calls: map[string]*call{}}
+}
+
+// do returns the result for key, calling fn if no other caller has.
+// fn is shared, so it is only cancelled once every caller's ctx is. Failed calls are forgotten, so they can be retried.
+func (c *callCache) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if existing, ok := c.calls[key]; ok {
+		existing.waiters++
+		c.mu.Unlock()
+		select {
+		case <-existing.done:
+			return existing.val, existing.err
+		case <-ctx.Done():
+			c.mu.Lock()
+			existing.waiters--
+			existing.cancelIfAbandoned()
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	callCtx, cancel := context.WithCancel(detachedContext{ctx})
+	cl := &call{done: make(chan struct{}), cancel: cancel}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			cl.gaveUp = true
+			cl.cancelIfAbandoned()
+			c.mu.Unlock()
+		case <-cl.done:
+		}
+	}()
+
+	// Release the waiters even if fn panics:
+	var returned bool
+	defer func() {
+		if !returned {
+			cl.err = errCallPanicked
+		}
+		if cl.err != nil {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+		}
+		cancel()
+		close(cl.done)
+	}()
+	cl.val, cl.err = fn(callCtx)
+	returned = true
+	return cl.val, cl.err
+}
+
+func (cl *call) cancelIfAbandoned() {
+	if cl.gaveUp && cl.waiters == 0 {
+		cl.cancel()
+	}
+}
+
+// detachedContext keeps the values of its parent, but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
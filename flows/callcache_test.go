@@ -0,0 +1,162 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallCache(t *testing.T) {
+	c := newCallCache()
+	ctx := context.Background()
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	// Concurrent callers share a call:
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.do(ctx, "key", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, "value", v)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Results are cached:
+	v, err := c.do(ctx, "key", fn)
+	require.NoError(t, err)
+	assert.Equal(t, "value", v)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCallCache_Errors(t *testing.T) {
+	c := newCallCache()
+	ctx := context.Background()
+
+	boom := errors.New("boom")
+	_, err := c.do(ctx, "key", func(context.Context) (interface{}, error) { return nil, boom })
+	assert.Equal(t, boom, err)
+
+	// Failures are retried:
+	v, err := c.do(ctx, "key", func(context.Context) (interface{}, error) { return "value", nil })
+	require.NoError(t, err)
+	assert.Equal(t, "value", v)
+}
+
+func TestCallCache_Cancel(t *testing.T) {
+	c := newCallCache()
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		_, _ = c.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+			<-release
+			return "value", nil
+		})
+	}()
+
+	// Wait for the call to start:
+	for {
+		c.mu.Lock()
+		_, started := c.calls["key"]
+		c.mu.Unlock()
+		if started {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.do(ctx, "key", func(context.Context) (interface{}, error) { return "other", nil })
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCallCache_Shared(t *testing.T) {
+	c := newCallCache()
+	first, cancelFirst := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_, _ = c.do(first, "key", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-release
+			return "value", ctx.Err()
+		})
+	}()
+	<-started
+
+	waited := make(chan interface{})
+	go func() {
+		v, err := c.do(context.Background(), "key", func(context.Context) (interface{}, error) { return "other", nil })
+		assert.NoError(t, err)
+		waited <- v
+	}()
+	waitForCall(c, func(cl *call) bool { return cl.waiters == 1 })
+
+	// The caller running the call gives up, but the waiter has not:
+	cancelFirst()
+	waitForCall(c, func(cl *call) bool { return cl.gaveUp })
+	close(release)
+	assert.Equal(t, "value", <-waited)
+}
+
+func TestCallCache_Abandoned(t *testing.T) {
+	c := newCallCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := c.do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func waitForCall(c *callCache, cond func(*call) bool) {
+	for {
+		c.mu.Lock()
+		cl, ok := c.calls["key"]
+		done := ok && cond(cl)
+		c.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func TestCallCache_Panic(t *testing.T) {
+	c := newCallCache()
+	waited := make(chan error)
+	assert.Panics(t, func() {
+		_, _ = c.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+			c.mu.Lock()
+			cl := c.calls["key"]
+			c.mu.Unlock()
+			go func() {
+				<-cl.done
+				waited <- cl.err
+			}()
+			panic("boom")
+		})
+	})
+
+	// Waiters are released, and the call is retried:
+	assert.Equal(t, errCallPanicked, <-waited)
+	v, err := c.do(context.Background(), "key", func(context.Context) (interface{}, error) { return "value", nil })
+	require.NoError(t, err)
+	assert.Equal(t, "value", v)
+}
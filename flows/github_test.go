@@ -0,0 +1,275 @@
+package flows_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+const (
+	fakeToken      = "s3cr3t"
+	fakeIndexJS    = "console.log('echo timer');"
+	fakeActionYAML = `
+name: Echo Timer
+inputs:
+  id:
+    required: true
+runs:
+  using: node12
+  main: dist/index.js
+`
+	fakeWorkflow = `
+on:
+  issue_comment:
+    types: created
+jobs:
+  echo-timer:
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: Cloud
+`
+)
+
+// newFakeGitHub serves a private repository using a private action, both requiring fakeToken.
+func newFakeGitHub(t *testing.T) (*httptest.Server, *[]string) {
+	var requestsMu sync.Mutex
+	var requests []string
+	contents := func(path, content string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, `{"type":"file","path":%q,"encoding":"base64","content":%q}`,
+				path, base64.StdEncoding.EncodeToString([]byte(content)))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"login":"thepwagner","type":"User"}`)
+	})
+	mux.HandleFunc("/orgs/thepwagner/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[
+			{"name":"echo-chamber","full_name":"thepwagner/echo-chamber","private":true,"topics":["fsb"]},
+			{"name":"no-workflows","full_name":"thepwagner/no-workflows","topics":["fsb"]},
+			{"name":"half-broken","full_name":"thepwagner/half-broken","topics":["fsb"]},
+			{"name":"old","full_name":"thepwagner/old","archived":true,"topics":["fsb"]},
+			{"name":"other","full_name":"thepwagner/other"}
+		]`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/contents/.github/workflows", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"type":"file","name":"cloud.yml","path":".github/workflows/cloud.yml"}]`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/contents/.github/workflows/cloud.yml", contents(".github/workflows/cloud.yml", fakeWorkflow))
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/actions/workflows/cloud.yml/runs", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "completed", r.URL.Query().Get("status"))
+		_, _ = fmt.Fprint(w, `{"total_count":3,"workflow_runs":[
+			{"id":3,"created_at":"2020-05-03T00:00:00Z"},
+			{"id":2,"created_at":"2020-05-02T00:00:00Z"},
+			{"id":1,"created_at":"2020-05-01T00:00:00Z"}
+		]}`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/actions/runs/3/jobs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"total_count":1,"jobs":[{"id":30,"conclusion":"skipped"}]}`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/actions/runs/2/jobs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"total_count":1,"jobs":[
+			{"id":20,"started_at":"2020-05-02T00:00:10Z","completed_at":"2020-05-02T00:00:40Z"}
+		]}`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-chamber/actions/runs/1/jobs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"total_count":2,"jobs":[
+			{"id":10,"started_at":"2020-05-01T00:00:30Z","completed_at":"2020-05-01T00:01:30Z"},
+			{"id":11,"started_at":"2020-05-01T00:00:40Z","completed_at":"2020-05-01T00:02:10Z"}
+		]}`)
+	})
+	mux.HandleFunc("/repos/thepwagner/half-broken/contents/.github/workflows", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[
+			{"type":"file","name":"broken.yml","path":".github/workflows/broken.yml"},
+			{"type":"file","name":"cloud.yml","path":".github/workflows/cloud.yml"}
+		]`)
+	})
+	mux.HandleFunc("/repos/thepwagner/half-broken/contents/.github/workflows/broken.yml", contents(".github/workflows/broken.yml", "on: [push\n"))
+	mux.HandleFunc("/repos/thepwagner/half-broken/contents/.github/workflows/cloud.yml", contents(".github/workflows/cloud.yml", fakeWorkflow))
+	mux.HandleFunc("/repos/thepwagner/reusing/contents/.github/workflows", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"type":"file","name":"call.yml","path":".github/workflows/call.yml"}]`)
+	})
+	mux.HandleFunc("/repos/thepwagner/reusing/contents/.github/workflows/call.yml", contents(".github/workflows/call.yml", `
+on: push
+jobs:
+  call:
+    uses: thepwagner/workflows/.github/workflows/echo.yml@main
+    with:
+      id: Cloud
+    secrets:
+      token: ${{ secrets.GITHUB_TOKEN }}
+`))
+	mux.HandleFunc("/repos/thepwagner/workflows/commits/main", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, echoTimerSHA)
+	})
+	mux.HandleFunc("/repos/thepwagner/workflows/contents/.github/workflows/echo.yml", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, echoTimerSHA, r.URL.Query().Get("ref"))
+		contents(".github/workflows/echo.yml", reusableWorkflow)(w, r)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-timer/commits/master", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, echoTimerSHA)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-timer/contents/action.yml", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, echoTimerSHA, r.URL.Query().Get("ref"))
+		contents("action.yml", fakeActionYAML)(w, r)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-timer/git/trees/"+echoTimerSHA, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"tree":[
+			{"path":"README.md","type":"blob","sha":"readme"},
+			{"path":"dist","type":"tree","sha":"dist"},
+			{"path":"dist/index.js","type":"blob","sha":"index"}
+		]}`)
+	})
+	mux.HandleFunc("/repos/thepwagner/echo-timer/git/blobs/index", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, fakeIndexJS)
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMu.Lock()
+		requests = append(requests, r.URL.Path)
+		requestsMu.Unlock()
+		// Like GitHub, private resources are hidden from unauthenticated requests:
+		if r.Header.Get("Authorization") != "Bearer "+fakeToken {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, `{"message":"Not Found"}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return srv, &requests
+}
+
+// redirectTransport sends every request to a test server, regardless of host.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestLoader_Load_Private(t *testing.T) {
+	srv, requests := newFakeGitHub(t)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+	ctx := context.Background()
+
+	cases := map[string]struct {
+		opts   []flows.Opt
+		loaded bool
+	}{
+		"token": {
+			opts:   []flows.Opt{flows.WithToken(fakeToken)},
+			loaded: true,
+		},
+		"host token": {
+			opts:   []flows.Opt{flows.WithHostToken("api.github.com", fakeToken)},
+			loaded: true,
+		},
+		"other host token": {
+			opts: []flows.Opt{flows.WithHostToken("github.example.com", fakeToken)},
+		},
+		"anonymous": {},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			*requests = nil
+			l, err := flows.NewLoader(append(tc.opts, flows.WithHTTPClient(client))...)
+			require.NoError(t, err)
+
+			loaded, _, err := l.Load(ctx, "thepwagner", "echo-chamber")
+			if !tc.loaded {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, loaded, 1)
+			require.Len(t, loaded[0].Steps(), 1)
+			step := loaded[0].Steps()[0]
+			assert.Equal(t, echoTimerSHA, step.SHA)
+			assert.Equal(t, map[string][]byte{"dist/index.js": []byte(fakeIndexJS)}, step.Files)
+			assert.Contains(t, *requests, "/repos/thepwagner/echo-timer/git/blobs/index")
+			assert.NotContains(t, *requests, "/repos/thepwagner/echo-timer/git/blobs/readme")
+		})
+	}
+}
+
+func TestLoader_TokenLogin(t *testing.T) {
+	srv, _ := newFakeGitHub(t)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	l, err := flows.NewLoader(flows.WithToken(fakeToken), flows.WithHTTPClient(client))
+	require.NoError(t, err)
+	login, err := l.TokenLogin(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "thepwagner", login)
+
+	// Installation tokens are not users:
+	l, err = flows.NewLoader(flows.WithHTTPClient(client))
+	require.NoError(t, err)
+	_, err = l.TokenLogin(context.Background())
+	assert.Error(t, err)
+}
+
+func TestLoader_Load_ConcurrentWorkflows(t *testing.T) {
+	const workflows = 4
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/thepwagner/many/contents/.github/workflows", func(w http.ResponseWriter, r *http.Request) {
+		var listing []string
+		for i := 0; i < workflows; i++ {
+			listing = append(listing, fmt.Sprintf(`{"type":"file","path":".github/workflows/wf%d.yml"}`, i))
+		}
+		_, _ = fmt.Fprintf(w, "[%s]", strings.Join(listing, ","))
+	})
+	mux.HandleFunc("/repos/thepwagner/many/contents/.github/workflows/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		_, _ = fmt.Fprintf(w, `{"type":"file","encoding":"base64","content":%q}`, base64.StdEncoding.EncodeToString([]byte(fakeWorkflow)))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+
+	l, err := flows.NewLoader(
+		flows.WithHTTPClient(&http.Client{Transport: redirectTransport{target: target}}),
+		flows.WithActionSource(newFakeActionSource()),
+		flows.WithConcurrency(workflows),
+	)
+	require.NoError(t, err)
+	loaded, reports, err := l.Load(context.Background(), "thepwagner", "many")
+	require.NoError(t, err)
+	assert.Len(t, loaded, workflows)
+	assert.Len(t, reports, workflows)
+	assert.Greater(t, maxInFlight, 1)
+}
@@ -0,0 +1,132 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/google/go-github/v30/github"
+	"github.com/sirupsen/logrus"
+)
+
+// RunHistory summarizes the recent completed runs of a workflow on GitHub Actions runners.
+type RunHistory struct {
+	Runs int
+	// Since and Until are the creation times of the oldest and newest sampled runs.
+	Since time.Time
+	Until time.Time
+	// QueueTime is the mean time between a run's creation and its first job starting.
+	QueueTime time.Duration
+	// RunTime is the mean time between a run's first job starting and its last job completing.
+	RunTime time.Duration
+	// RunnerMinutes is the mean billable runner minutes per run, rounding each job up to the minute.
+	RunnerMinutes float64
+}
+
+// RunsPerMonth extrapolates the sampled runs to a 30 day month.
+func (h RunHistory) RunsPerMonth() float64 {
+	period := h.Until.Sub(h.Since)
+	if h.Runs < 2 || period <= 0 {
+		return float64(h.Runs)
+	}
+	const month = 30 * 24 * time.Hour
+	return float64(h.Runs-1) * float64(month) / float64(period)
+}
+
+// RunHistory samples up to maxRuns of the most recent completed runs of a workflow.
+func (l *Loader) RunHistory(ctx context.Context, owner, repo, workflowPath string, maxRuns int) (RunHistory, error) {
+	var h RunHistory
+	var queued, ran time.Duration
+	opts := &github.ListWorkflowRunsOptions{
+		Status:      "completed",
+		ListOptions: github.ListOptions{PerPage: maxRuns},
+	}
+	for h.Runs < maxRuns {
+		runs, resp, err := l.gh.Actions.ListWorkflowRunsByFileName(ctx, owner, repo, path.Base(workflowPath), opts)
+		if err != nil {
+			return RunHistory{}, fmt.Errorf("listing runs of %q: %w", workflowPath, err)
+		}
+		for _, run := range runs.WorkflowRuns {
+			if h.Runs == maxRuns {
+				break
+			}
+			jobs, _, err := l.gh.Actions.ListWorkflowJobs(ctx, owner, repo, run.GetID(), &github.ListWorkflowJobsOptions{
+				ListOptions: github.ListOptions{PerPage: 100},
+			})
+			if err != nil {
+				return RunHistory{}, fmt.Errorf("listing jobs of run %d: %w", run.GetID(), err)
+			}
+			started, completed, minutes := jobTimes(jobs.Jobs)
+			if started.IsZero() {
+				// Skipped or cancelled before any job started
+				continue
+			}
+
+			created := run.GetCreatedAt().Time
+			h.Runs++
+			if h.Since.IsZero() || created.Before(h.Since) {
+				h.Since = created
+			}
+			if created.After(h.Until) {
+				h.Until = created
+			}
+			queued += started.Sub(created)
+			ran += completed.Sub(started)
+			h.RunnerMinutes += minutes
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	if h.Runs > 0 {
+		h.QueueTime = queued / time.Duration(h.Runs)
+		h.RunTime = ran / time.Duration(h.Runs)
+		h.RunnerMinutes /= float64(h.Runs)
+	}
+	return h, nil
+}
+
+// jobTimes returns when the first job of a run started, when the last completed, and the billable minutes of all jobs.
+func jobTimes(jobs []*github.WorkflowJob) (started, completed time.Time, minutes float64) {
+	for _, job := range jobs {
+		if job.StartedAt == nil || job.CompletedAt == nil {
+			continue
+		}
+		start, end := job.GetStartedAt().Time, job.GetCompletedAt().Time
+		if started.IsZero() || start.Before(started) {
+			started = start
+		}
+		if end.After(completed) {
+			completed = end
+		}
+		if d := end.Sub(start); d > 0 {
+			minutes += float64((d + time.Minute - 1) / time.Minute)
+		}
+	}
+	return started, completed, minutes
+}
+
+// AddRunHistory samples up to maxRuns of each workflow in the report.
+// Workflows whose history cannot be read are left without one.
+func (l *Loader) AddRunHistory(ctx context.Context, report *OrgReport, maxRuns int) error {
+	for i := range report.Repos {
+		repo := &report.Repos[i]
+		owner, name := path.Split(repo.Repo)
+		for j := range repo.Workflows {
+			wf := &repo.Workflows[j]
+			h, err := l.RunHistory(ctx, path.Clean(owner), name, wf.Workflow, maxRuns)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logrus.WithError(err).WithField("repo", repo.Repo).WithField("workflow", wf.Workflow).Warn("Reading run history")
+				continue
+			}
+			wf.History = &h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package flows_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestLoader_RunHistory(t *testing.T) {
+	srv, _ := newFakeGitHub(t)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	l, err := flows.NewLoader(flows.WithHTTPClient(client), flows.WithToken(fakeToken))
+	require.NoError(t, err)
+	h, err := l.RunHistory(context.Background(), "thepwagner", "echo-chamber", ".github/workflows/cloud.yml", 10)
+	require.NoError(t, err)
+
+	// The skipped run is not sampled:
+	assert.Equal(t, flows.RunHistory{
+		Runs:          2,
+		Since:         time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		Until:         time.Date(2020, 5, 2, 0, 0, 0, 0, time.UTC),
+		QueueTime:     20 * time.Second,
+		RunTime:       65 * time.Second,
+		RunnerMinutes: 2,
+	}, h)
+	assert.Equal(t, 30.0, h.RunsPerMonth())
+
+	h, err = l.RunHistory(context.Background(), "thepwagner", "echo-chamber", ".github/workflows/cloud.yml", 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Runs)
+	assert.Equal(t, 10*time.Second, h.QueueTime)
+}
+
+func TestRunHistory_RunsPerMonth(t *testing.T) {
+	assert.Equal(t, 0.0, flows.RunHistory{}.RunsPerMonth())
+	assert.Equal(t, 1.0, flows.RunHistory{Runs: 1}.RunsPerMonth())
+}
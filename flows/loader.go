@@ -2,17 +2,17 @@ package flows
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"path"
+	"regexp"
 	"strings"
 	"sync"
 
 	"github.com/google/go-github/v30/github"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v2"
 )
 
@@ -24,42 +24,243 @@ const (
 )
 
 type Loader struct {
-	ghPublic *github.Client
-	client   *http.Client
+	gh     *github.Client
+	client *http.Client
 
-	token          string
-	ghPrivateSetup sync.Once
-	ghPrivate      *github.Client
+	// token authenticates the GitHub API, hostTokens authenticate specific hosts:
+	token      string
+	hostTokens map[string]string
 
-	jsStepMu sync.Mutex
-	jsSteps  map[string]Action
+	// GitHub Enterprise Server endpoints, github.com if unset:
+	baseURL       string
+	uploadURL     string
+	githubConnect bool
+
+	lock    *Lockfile
+	policy  ActionPolicy
+	actions ActionSource
+	// Wrap actions in a cache in this directory, offline if set:
+	actionCacheDir string
+	offline        bool
+
+	// HTTP responses are cached in this directory, if set:
+	httpCacheDir string
+	rateLimit    *rateLimitTransport
+
+	// concurrency bounds parallel workflow loads, and parallel action fetches via fetchSem:
+	concurrency int
+	fetchSem    chan struct{}
+	// Pinned SHAs by `uses:`, and Actions by "owner/name@sha":
+	refs          *callCache
+	jsSteps       *callCache
+	workflowFiles *callCache
 }
 
-func NewLoader(opts ...Opt) *Loader {
+func NewLoader(opts ...Opt) (*Loader, error) {
 	l := &Loader{
-		client:  http.DefaultClient,
-		jsSteps: make(map[string]Action),
+		client:        http.DefaultClient,
+		hostTokens:    map[string]string{},
+		lock:          NewLockfile(),
+		concurrency:   4,
+		refs:          newCallCache(),
+		jsSteps:       newCallCache(),
+		workflowFiles: newCallCache(),
 	}
 	for _, opt := range opts {
 		opt(l)
 	}
-	l.ghPublic = github.NewClient(l.client)
-	return l
+	if l.concurrency < 1 {
+		l.concurrency = 1
+	}
+	l.fetchSem = make(chan struct{}, l.concurrency)
+
+	// Authenticate every request to a host we have credentials for:
+	tokens := make(map[string]string, len(l.hostTokens)+1)
+	if l.token != "" {
+		apiHost := "api.github.com"
+		if l.baseURL != "" {
+			u, err := url.Parse(l.baseURL)
+			if err != nil {
+				return nil, fmt.Errorf("parsing base URL: %w", err)
+			}
+			apiHost = u.Host
+		}
+		tokens[apiHost] = l.token
+	}
+	for host, token := range l.hostTokens {
+		tokens[host] = token
+	}
+	client := *l.client
+	l.rateLimit = newRateLimitTransport(client.Transport)
+	var transport http.RoundTripper = l.rateLimit
+	if l.httpCacheDir != "" {
+		transport = newHTTPCacheTransport(transport, l.httpCacheDir)
+	}
+	client.Transport = newHostTokenTransport(transport, tokens)
+	l.client = &client
+
+	var err error
+	if l.gh, err = l.newGitHubClient(l.client); err != nil {
+		return nil, err
+	}
+
+	if l.actions == nil {
+		l.actions = NewGitHubActionSource(l.gh)
+		if l.baseURL != "" && l.githubConnect {
+			// Like GitHub Connect, actions missing from the enterprise server are resolved from github.com:
+			l.actions = NewFallbackActionSource(l.actions, NewGitHubActionSource(github.NewClient(l.client)))
+		}
+	}
+	if l.offline {
+		l.actions = NewCacheActionSource(l.actionCacheDir, nil)
+	} else if l.actionCacheDir != "" {
+		l.actions = NewCacheActionSource(l.actionCacheDir, l.actions)
+	}
+	return l, nil
+}
+
+func (l *Loader) newGitHubClient(httpClient *http.Client) (*github.Client, error) {
+	if l.baseURL == "" {
+		return github.NewClient(httpClient), nil
+	}
+	uploadURL := l.uploadURL
+	if uploadURL == "" {
+		uploadURL = l.baseURL
+	}
+	gh, err := github.NewEnterpriseClient(l.baseURL, uploadURL, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("configuring GitHub Enterprise client: %w", err)
+	}
+	return gh, nil
 }
 
 type Opt func(*Loader)
 
+// WithToken authenticates requests to the GitHub API, for private workflows and actions.
 func WithToken(token string) Opt {
 	return func(l *Loader) {
 		l.token = token
 	}
 }
 
+// WithHostToken authenticates requests to a host, e.g. "api.github.com" when WithBaseURL targets GitHub Enterprise Server.
+func WithHostToken(host, token string) Opt {
+	return func(l *Loader) {
+		l.hostTokens[host] = token
+	}
+}
+
+// WithHTTPClient replaces the client used for all requests.
+func WithHTTPClient(client *http.Client) Opt {
+	return func(l *Loader) {
+		l.client = client
+	}
+}
+
+// WithBaseURL targets a GitHub Enterprise Server, e.g. "https://github.example.com/".
+func WithBaseURL(baseURL string) Opt {
+	return func(l *Loader) {
+		l.baseURL = baseURL
+	}
+}
+
+// WithUploadURL sets the GitHub Enterprise Server upload endpoint, defaults to the base URL.
+func WithUploadURL(uploadURL string) Opt {
+	return func(l *Loader) {
+		l.uploadURL = uploadURL
+	}
+}
+
+// WithGitHubConnect resolves actions missing from GitHub Enterprise Server from github.com.
+func WithGitHubConnect() Opt {
+	return func(l *Loader) {
+		l.githubConnect = true
+	}
+}
+
+// WithHTTPCache persists API responses to a directory, revalidating them with conditional requests.
+func WithHTTPCache(dir string) Opt {
+	return func(l *Loader) {
+		l.httpCacheDir = dir
+	}
+}
+
+// WithConcurrency sets how many workflows are loaded, and actions fetched, in parallel.
+func WithConcurrency(n int) Opt {
+	return func(l *Loader) {
+		l.concurrency = n
+	}
+}
+
+// WithLockfile reuses the SHAs pinned by a lockfile, and records newly resolved references in it.
+func WithLockfile(lock *Lockfile) Opt {
+	return func(l *Loader) {
+		l.lock = lock
+	}
+}
+
+// WithPolicy restricts the actions that may be loaded.
+func WithPolicy(policy ActionPolicy) Opt {
+	return func(l *Loader) {
+		l.policy = policy
+	}
+}
+
+// WithActionSource replaces where actions are fetched from, by default the GitHub API.
+func WithActionSource(src ActionSource) Opt {
+	return func(l *Loader) {
+		l.actions = src
+	}
+}
+
+// WithActionCache caches actions in a directory. If offline, actions missing from the cache are an error.
+func WithActionCache(dir string, offline bool) Opt {
+	return func(l *Loader) {
+		l.actionCacheDir = dir
+		l.offline = offline
+	}
+}
+
 // LoadedFlow is a .yaml workflow that can be ported to AzureFunctions.
 type LoadedFlow struct {
 	Name     string
 	Triggers []Trigger
-	Steps    []LoadedStep
+	// Concurrency serializes or cancels runs of the whole workflow.
+	Concurrency *Concurrency
+	Jobs        []LoadedJob
+}
+
+// Steps returns the steps of every instance of every job.
+func (f LoadedFlow) Steps() []LoadedStep {
+	var steps []LoadedStep
+	for _, job := range f.Jobs {
+		for _, instance := range job.Instances {
+			steps = append(steps, instance.Steps...)
+		}
+	}
+	return steps
+}
+
+// LoadedJob is a job of a workflow, expanded into an instance per combination of its matrix.
+type LoadedJob struct {
+	Name string
+	// FailFast cancels the job's other instances when one fails.
+	FailFast bool
+	// MaxParallel limits how many instances run at once, unlimited if 0.
+	MaxParallel int
+	Instances   []JobInstance
+}
+
+// JobInstance is a job, for one combination of its matrix.
+type JobInstance struct {
+	Name   string
+	Matrix map[string]string
+	// TimeoutMinutes cancels the instance if set, ContinueOnError keeps its failure from failing the workflow.
+	TimeoutMinutes  float64
+	ContinueOnError bool
+	// Concurrency serializes or cancels runs of the instance.
+	Concurrency *Concurrency
+	Steps       []LoadedStep
 }
 
 // Trigger is an event that triggers a workflow, from the YAML `on:`.
@@ -70,129 +271,339 @@ type Trigger struct {
 
 // LoadedStep is a step of a LoadedFlow
 type LoadedStep struct {
-	Name       string
-	SourceCode string
-	Inputs     map[string]string
+	Name string
+	// Action is the step's `uses:`, SHA is the commit it was pinned to.
+	Action ActionReference
+	SHA    string
+	// Main is the entrypoint within Files, from the action's `runs.main`.
+	Main string
+	// Files of the action's bundle (e.g. `dist/`), by path within the action repository.
+	Files  map[string][]byte
+	Inputs map[string]string
+	Env    map[string]string
+	// Outputs declared by the step's action.
+	Outputs map[string]ActionOutput
+	// TimeoutMinutes cancels the step if set, ContinueOnError lets the job continue after the step fails.
+	TimeoutMinutes  float64
+	ContinueOnError bool
+}
+
+// Budget reports the GitHub API usage of the loader so far.
+func (l *Loader) Budget() APIBudget {
+	return l.rateLimit.Budget()
+}
+
+// Load fetches the workflows of a GitHub repository, returning those that can be ported
+// and a compatibility Report for every workflow.
+func (l *Loader) Load(ctx context.Context, owner, name string) ([]LoadedFlow, []Report, error) {
+	return l.LoadSource(ctx, l.repoSource(owner, name))
 }
 
-func (l *Loader) Load(ctx context.Context, owner, name string) ([]LoadedFlow, error) {
+func (l *Loader) repoSource(owner, name string) WorkflowSource {
+	return &gitHubSource{
+		gh:    l.gh,
+		owner: owner,
+		name:  name,
+	}
+}
+
+// LoadSource is Load, for workflows from any WorkflowSource.
+func (l *Loader) LoadSource(ctx context.Context, src WorkflowSource) ([]LoadedFlow, []Report, error) {
+	return l.loadSource(ctx, src, false)
+}
+
+// loadSource loads the workflows of a source. If tolerant, a workflow that fails to load is
+// reported with a blocker instead of failing the others.
+func (l *Loader) loadSource(ctx context.Context, src WorkflowSource, tolerant bool) ([]LoadedFlow, []Report, error) {
 	// List the actions directory to detect workflows:
-	logger := logrus.WithField("repo", fmt.Sprintf("%s/%s", owner, name))
+	logger := logrus.WithField("source", src)
 	logger.WithField("path", actionsPath).Debug("Listing workflows...")
-	_, listing, _, err := l.ghPrivateClient(ctx).Repositories.GetContents(ctx, owner, name, actionsPath, &github.RepositoryContentGetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("fetching workflows: %w", err)
+	var workflows []WorkflowFile
+	var read workflowReader
+	if lazy, ok := src.(lazySource); ok {
+		// Contents are fetched by the workers:
+		paths, err := lazy.workflowPaths(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range paths {
+			workflows = append(workflows, WorkflowFile{Path: p})
+		}
+		read = l.sourceWorkflowReader(lazy)
+	} else {
+		var err error
+		if workflows, err = src.Workflows(ctx); err != nil {
+			return nil, nil, err
+		}
+		local := make(map[string][]byte, len(workflows))
+		for _, wf := range workflows {
+			local[wf.Path] = wf.Content
+		}
+		read = func(_ context.Context, p string) ([]byte, error) {
+			content, ok := local[p]
+			if !ok {
+				return nil, fmt.Errorf("workflow %q not found", p)
+			}
+			return content, nil
+		}
+	}
+	logger.WithField("workflows", len(workflows)).Debug("Listed workflows")
+
+	// Attempt to load each workflow, cancelling the others on the first error:
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		loaded  *LoadedFlow
+		report  Report
+		done    bool
+		skipped bool
+		err     error
+	}
+	results := make([]result, len(workflows))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < l.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				loaded, report, err := l.loadWorkflow(ctx, logger, read, workflows[i])
+				if errors.Is(err, errSkipWorkflow) {
+					results[i] = result{done: true, skipped: true}
+					continue
+				}
+				if err != nil && tolerant && ctx.Err() == nil {
+					logger.WithError(err).WithField("workflow", workflows[i].Path).Warn("Loading workflow")
+					report.Blockers = append(report.Blockers, Issue{Step: "workflow", Kind: "workflow could not be loaded", Reason: err.Error()})
+					err = nil
+				}
+				if err != nil {
+					err = fmt.Errorf("loading workflow %q: %w", workflows[i].Path, err)
+					cancel()
+				}
+				results[i] = result{loaded: loaded, report: report, done: true, err: err}
+			}
+		}()
 	}
-	logger.WithField("workflows", len(listing)).Debug("Listed workflows")
+queue:
+	for i := range workflows {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(work)
+	wg.Wait()
 
-	// Attempt to load each workflow:
 	var jobs []LoadedFlow
-	for _, wf := range listing {
-		loaded, err := l.loadWorkflow(ctx, logger, wf)
-		if err != nil {
-			return nil, fmt.Errorf("loading workflow %q: %w", *wf.Path, err)
+	var reports []Report
+	var done int
+	for _, r := range results {
+		if r.err != nil {
+			return nil, nil, r.err
 		}
-		if loaded != nil {
-			jobs = append(jobs, *loaded)
+		if r.done {
+			done++
 		}
+		if !r.done || r.skipped {
+			continue
+		}
+		reports = append(reports, r.report)
+		if r.loaded != nil {
+			jobs = append(jobs, *r.loaded)
+		}
+	}
+	if err := ctx.Err(); err != nil && done < len(workflows) {
+		return nil, nil, err
 	}
-	return jobs, nil
+	return jobs, reports, nil
 }
 
-func (l *Loader) ghPrivateClient(ctx context.Context) *github.Client {
-	l.ghPrivateSetup.Do(func() {
-		if l.token == "" {
-			l.ghPrivate = l.ghPublic
-			return
+// errSkipWorkflow is returned by loadWorkflow for workflows that are neither converted nor reported.
+var errSkipWorkflow = errors.New("skip workflow")
+
+func (l *Loader) loadWorkflow(ctx context.Context, logger logrus.FieldLogger, read workflowReader, wf WorkflowFile) (*LoadedFlow, Report, error) {
+	report := Report{Workflow: path.Base(wf.Path)}
+	logger = logger.WithField("workflow", report.Workflow)
+
+	content := wf.Content
+	if content == nil {
+		var err error
+		if content, err = read(ctx, wf.Path); err != nil {
+			return nil, report, err
 		}
-		clientCtx := context.WithValue(ctx, oauth2.HTTPClient, l.client)
-		l.ghPrivate = github.NewClient(
-			oauth2.NewClient(clientCtx,
-				oauth2.StaticTokenSource(&oauth2.Token{AccessToken: l.token}),
-			))
-	})
-	return l.ghPrivate
-}
+	}
+	var flow Workflow
+	if err := yaml.Unmarshal(content, &flow); err != nil {
+		return nil, report, fmt.Errorf("decoding workflow: %w", err)
+	}
+	logger.Debug("Fetched and parsed workflow")
 
-func (l *Loader) loadWorkflow(ctx context.Context, logger logrus.FieldLogger, wf *github.RepositoryContent) (*LoadedFlow, error) {
-	wfName := wf.GetName()
-	logger = logrus.WithField("workflow", wfName)
-	logger.Debug("Fetching workflow...")
-	resp, err := l.client.Get(*wf.DownloadURL)
+	triggers, err := flow.Triggers()
 	if err != nil {
-		return nil, fmt.Errorf("fetching workflow %q: %w", wfName, err)
+		return nil, report, err
+	}
+	// Reusable workflows are converted as part of their callers, they are not reported on their own:
+	var events []Trigger
+	for _, t := range triggers {
+		if t.Event != workflowCallEvent {
+			events = append(events, t)
+		}
+	}
+	if len(triggers) > 0 && len(events) == 0 {
+		logger.Debug("Skipping reusable workflow")
+		return nil, report, errSkipWorkflow
 	}
-	defer resp.Body.Close()
 
-	var flow Workflow
-	if err := yaml.NewDecoder(resp.Body).Decode(&flow); err != nil {
-		return nil, fmt.Errorf("decoding workflow %q: %w", wfName, err)
+	l.prefetchActions(ctx, flow)
+	workflowJobs, err := l.workflowJobs(ctx, logger, &report, read, flow, "", 0)
+	if err != nil {
+		return nil, report, err
 	}
-	logger.Debug("Fetched and parsed workflow")
+	report.Blockers = append(report.Blockers, concurrencyIssues("concurrency", flow.Concurrency)...)
 
-	var ls []LoadedStep
-	for jobName, job := range flow.Jobs {
+	var jobs []LoadedJob
+	for _, wj := range workflowJobs {
+		jobName, job := wj.name, wj.job
 		jobLogger := logger.WithField("job", jobName)
-		for stepIndex, step := range job.Steps {
-			stepLogger := jobLogger.WithField("step", stepIndex)
-			action, err := l.fetchActionYAML(ctx, step.Uses)
+		combos, err := job.Strategy.Matrix.Expand()
+		if err != nil {
+			jobLogger.WithError(err).Info("Job matrix is not supported")
+			report.Blockers = append(report.Blockers, Issue{Step: jobName, Kind: "matrix is not supported", Reason: err.Error()})
+			continue
+		}
+
+		lj := LoadedJob{
+			Name:        jobName,
+			FailFast:    job.Strategy.FailsFast(),
+			MaxParallel: job.Strategy.MaxParallel,
+		}
+		for _, combo := range combos {
+			instance, err := l.loadJobInstance(ctx, jobLogger, &report, wj.env, job, job.Strategy.Matrix.InstanceName(jobName, combo), combo)
 			if err != nil {
-				return nil, fmt.Errorf("loading action metadata %q: %w", step.Uses, err)
-			}
-			if !action.FunctionCompatible() {
-				stepLogger.Info("Step is not compatible, skipping workflow")
-				return nil, nil
+				return nil, report, err
 			}
-			stepLogger.Debug("Compatible step detected")
+			lj.Instances = append(lj.Instances, instance)
+		}
+		jobs = append(jobs, lj)
+	}
+	if !report.Compatible() {
+		logger.WithField("blockers", len(report.Blockers)).Info("Workflow is not compatible, skipping")
+		return nil, report, nil
+	}
+	logger.Info("Node workflow detected, converting...")
 
-			inputs := map[string]string{}
-			for k, v := range step.With {
-				if strings.Contains(v, "${{") && !strings.Contains(v, "secrets.GITHUB_TOKEN") {
-					stepLogger.Info("Step uses interpolation, skipping workflow")
-					return nil, nil
-				}
-				inputs[k] = v
-			}
+	f := &LoadedFlow{
+		Name:        report.Workflow,
+		Triggers:    events,
+		Concurrency: flow.Concurrency,
+		Jobs:        jobs,
+	}
+
+	return f, report, nil
+}
 
-			ls = append(ls, LoadedStep{
-				Name:       fmt.Sprintf("%s-%d", jobName, stepIndex),
-				SourceCode: action.SourceCode,
-				Inputs:     step.With,
-			})
+// loadJobInstance loads the steps of a job for one combination of its matrix, recording issues in the report.
+func (l *Loader) loadJobInstance(ctx context.Context, logger logrus.FieldLogger, report *Report, workflowEnv map[string]string, job *Job, name string, combo map[string]string) (JobInstance, error) {
+	instance := JobInstance{Name: name, Matrix: combo}
+	var issues []Issue
+	instance.TimeoutMinutes, issues = staticMinutes(name, "timeout-minutes", resolveContext(job.TimeoutMinutes, "matrix", combo))
+	report.Blockers = append(report.Blockers, issues...)
+	instance.ContinueOnError, issues = staticBool(name, "continue-on-error", resolveContext(job.ContinueOnError, "matrix", combo))
+	report.Blockers = append(report.Blockers, issues...)
+	if job.Concurrency != nil {
+		instance.Concurrency = &Concurrency{
+			Group:            resolveContext(job.Concurrency.Group, "matrix", combo),
+			CancelInProgress: job.Concurrency.CancelInProgress,
 		}
-		jobLogger.Info("Node workflow detected, converting...")
+		report.Blockers = append(report.Blockers, concurrencyIssues(name, instance.Concurrency)...)
 	}
 
-	f := &LoadedFlow{
-		Name:  filepath.Base(*wf.Path),
-		Steps: ls,
-	}
-
-	switch on := flow.On.(type) {
-	case string:
-		f.Triggers = append(f.Triggers, Trigger{Event: on})
-	case map[interface{}]interface{}:
-		for event, details := range on {
-			trigger := Trigger{Event: event.(string)}
-			if detailsMap, ok := details.(map[interface{}]interface{}); ok {
-				if types, ok := detailsMap["types"]; ok {
-					switch actions := types.(type) {
-					case string:
-						trigger.Actions = []string{actions}
-					case []string:
-						trigger.Actions = actions
-					default:
-						return nil, fmt.Errorf("unexpected `types` type: %T", flow.On)
-					}
-				}
-			}
+	// Outputs declared by the job's previous steps, by step id:
+	outputs := map[string]map[string]ActionOutput{}
+	for stepIndex, step := range job.Steps {
+		stepName := fmt.Sprintf("%s-%d", name, stepIndex)
+		stepLogger := logger.WithField("step", stepIndex)
+		if len(combo) > 0 {
+			stepLogger = stepLogger.WithField("instance", name)
+		}
+		report.Steps++
+		action, err := l.fetchActionYAML(ctx, step.Uses)
+		if errors.Is(err, ErrActionNotAllowed) {
+			stepLogger.WithError(err).Info("Step is not allowed")
+			report.Blockers = append(report.Blockers, Issue{Step: stepName, Kind: ErrActionNotAllowed.Error(), Reason: err.Error()})
+			continue
+		} else if err != nil {
+			return instance, fmt.Errorf("loading action metadata %q: %w", step.Uses, err)
+		}
+		for _, deprecation := range action.Deprecations(step.With) {
+			stepLogger.Warn(deprecation)
+			report.Warnings = append(report.Warnings, Issue{Step: stepName, Kind: "uses deprecated inputs", Reason: deprecation})
+		}
+		if !action.FunctionCompatible() {
+			stepLogger.Info("Step is not compatible")
+			report.Blockers = append(report.Blockers, Issue{Step: stepName, Kind: "action is not function compatible", Reason: "action is not function compatible"})
+			continue
+		}
+		stepLogger.Debug("Compatible step detected")
 
-			f.Triggers = append(f.Triggers, trigger)
+		inputs, err := action.ApplyInputs(step.With)
+		if err != nil {
+			return instance, fmt.Errorf("job %q step %d (%s): %w", name, stepIndex, step.Uses, err)
 		}
-	default:
-		return nil, fmt.Errorf("unexpected `on` type: %T", flow.On)
+		env := MergeEnv(workflowEnv, job.Env, step.Env)
+		for k, v := range inputs {
+			inputs[k] = resolveContext(v, "matrix", combo)
+		}
+		for k, v := range env {
+			env[k] = resolveContext(v, "matrix", combo)
+		}
+		actionRef, _ := ParseActionReference(step.Uses)
+		timeoutMinutes, issues := staticMinutes(stepName, "timeout-minutes", resolveContext(step.TimeoutMinutes, "matrix", combo))
+		continueOnError, boolIssues := staticBool(stepName, "continue-on-error", resolveContext(step.ContinueOnError, "matrix", combo))
+		issues = append(issues, boolIssues...)
+		issues = append(issues, expressionIssues(stepName, outputs, inputs, env)...)
+		if len(issues) > 0 {
+			stepLogger.Info("Step uses interpolation")
+			report.Blockers = append(report.Blockers, issues...)
+		} else {
+			report.CompatibleSteps++
+			report.Actions = append(report.Actions, actionRef.Repo())
+		}
+		if step.ID != "" {
+			outputs[step.ID] = action.Outputs
+		}
+
+		instance.Steps = append(instance.Steps, LoadedStep{
+			Name:    stepName,
+			Action:  actionRef,
+			SHA:     action.SHA,
+			Main:    action.Runs.Main,
+			Files:   action.Files,
+			Inputs:  inputs,
+			Env:     env,
+			Outputs: action.Outputs,
+
+			TimeoutMinutes:  timeoutMinutes,
+			ContinueOnError: continueOnError,
+		})
 	}
-	return f, nil
+	return instance, nil
+}
+
+// interpolated returns true if the value contains an expression that can't be resolved at deploy time.
+func interpolated(v string) bool {
+	return strings.Contains(v, "${{") && !IsTokenExpression(v)
+}
+
+// IsTokenExpression returns true if the value is an expression for the workflow's token.
+func IsTokenExpression(v string) bool {
+	switch strings.Join(strings.Fields(v), "") {
+	case "${{secrets.GITHUB_TOKEN}}", "${{github.token}}":
+		return true
+	}
+	return false
 }
 
 func (l *Loader) IsNodeStep(ctx context.Context, step Step) (bool, error) {
@@ -204,50 +615,117 @@ func (l *Loader) IsNodeStep(ctx context.Context, step Step) (bool, error) {
 	return action.FunctionCompatible(), nil
 }
 
-func (l *Loader) fetchActionYAML(ctx context.Context, uses string) (Action, error) {
-	// Have we checked this step before?
-	l.jsStepMu.Lock()
-	defer l.jsStepMu.Unlock()
-	if stored, cached := l.jsSteps[uses]; cached {
-		return stored, nil
+// prefetchActions fetches the workflow's actions in parallel, so steps are then loaded from cache.
+// Errors are ignored, they are reported when the step is loaded.
+func (l *Loader) prefetchActions(ctx context.Context, flow Workflow) {
+	uses := map[string]struct{}{}
+	for _, job := range flow.Jobs {
+		for _, step := range job.Steps {
+			uses[step.Uses] = struct{}{}
+		}
 	}
 
+	var wg sync.WaitGroup
+	for u := range uses {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			_, _ = l.fetchActionYAML(ctx, u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (l *Loader) fetchActionYAML(ctx context.Context, uses string) (Action, error) {
 	ref, ok := ParseActionReference(uses)
 	if !ok {
 		return Action{}, nil
 	}
+	if err := l.policy.Allows(ref); err != nil {
+		return Action{}, err
+	}
 
-	ghClient := l.ghPublic
-	contentsResp, _, _, err := ghClient.Repositories.GetContents(ctx, ref.RepoOwner, ref.RepoName, actionsMetadataFile, &github.RepositoryContentGetOptions{Ref: ref.Ref})
+	sha, err := l.refs.do(ctx, uses, func(ctx context.Context) (interface{}, error) {
+		return l.resolveRef(ctx, uses, ref)
+	})
 	if err != nil {
-		return Action{}, fmt.Errorf("fetching action metadata: %w", err)
+		return Action{}, fmt.Errorf("resolving action ref: %w", err)
 	}
-	contents, err := contentsResp.GetContent()
+
+	// Have we checked this step before?
+	key := fmt.Sprintf("%s/%s@%s", ref.RepoOwner, ref.RepoName, sha)
+	fetched, err := l.jsSteps.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return l.fetchAction(ctx, ref, sha.(string))
+	})
 	if err != nil {
-		return Action{}, fmt.Errorf("decoding action metadata contents: %w", err)
+		return Action{}, err
 	}
-	var action Action
-	if err := yaml.Unmarshal([]byte(contents), &action); err != nil {
-		return Action{}, fmt.Errorf("decoding action metadata: %w", err)
+	action := fetched.(Action)
+
+	// Guard against upstream content changing under the same ref:
+	if err := l.lock.checkHash(uses, action.ContentHash()); err != nil {
+		return Action{}, err
 	}
+	return action, nil
+}
 
-	if action.FunctionCompatible() {
-		contentsResp, _, _, err := ghClient.Repositories.GetContents(ctx, ref.RepoOwner, ref.RepoName, action.Runs.Main, &github.RepositoryContentGetOptions{Ref: ref.Ref})
-		if err != nil {
-			return Action{}, fmt.Errorf("fetching action metadata: %w", err)
+// fetchAction verifies and fetches an action from the ActionSource, bounded by the loader's concurrency.
+func (l *Loader) fetchAction(ctx context.Context, ref ActionReference, sha string) (Action, error) {
+	select {
+	case l.fetchSem <- struct{}{}:
+		defer func() { <-l.fetchSem }()
+	case <-ctx.Done():
+		return Action{}, ctx.Err()
+	}
+
+	if l.policy.RequireVerified {
+		verifier, ok := l.actions.(refVerifier)
+		if !ok {
+			return Action{}, fmt.Errorf("%w: action source can not verify refs", ErrActionNotAllowed)
+		}
+		if err := verifier.Verify(ctx, ref, sha); err != nil {
+			return Action{}, err
 		}
-		contents, err := contentsResp.GetContent()
+	}
+	return l.actions.Fetch(ctx, ref, sha)
+}
+
+var shaRe = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// resolveRef pins an action reference to a commit SHA, preferring the lockfile.
+func (l *Loader) resolveRef(ctx context.Context, uses string, ref ActionReference) (string, error) {
+	if locked, ok := l.lock.get(uses); ok {
+		return locked.SHA, nil
+	}
+
+	sha := ref.Ref
+	if !shaRe.MatchString(sha) {
+		select {
+		case l.fetchSem <- struct{}{}:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		var err error
+		sha, err = l.actions.Resolve(ctx, ref)
+		<-l.fetchSem
 		if err != nil {
-			return Action{}, fmt.Errorf("decoding action metadata contents: %w", err)
+			return "", err
 		}
-		action.SourceCode = contents
+		logrus.WithFields(logrus.Fields{
+			"uses": uses,
+			"sha":  sha,
+		}).Debug("Pinned action ref")
 	}
+	l.lock.set(uses, LockedAction{SHA: sha})
+	return sha, nil
+}
 
-	l.jsSteps[uses] = action
-	return action, nil
+// Dir is where the step's action files are packaged, stable for a given action and SHA.
+func (s LoadedStep) Dir() string {
+	return path.Join("actions", s.Action.RepoOwner, s.Action.RepoName, s.SHA)
 }
 
-func (s LoadedStep) Filename() string {
-	hash := sha256.Sum256([]byte(s.SourceCode))
-	return hex.EncodeToString(hash[:])
+// MainPath is the packaged path of the step's entrypoint.
+func (s LoadedStep) MainPath() string {
+	return path.Join(s.Dir(), s.Main)
 }
@@ -2,7 +2,13 @@ package flows_test
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,11 +19,13 @@ import (
 func TestLoader_Load(t *testing.T) {
 	token := os.Getenv("GITHUB_TOKEN")
 
-	l := flows.NewLoader(flows.WithToken(token))
+	l, err := flows.NewLoader(flows.WithToken(token))
+	require.NoError(t, err)
 
 	ctx := context.Background()
-	jobs, err := l.Load(ctx, "thepwagner", "echo-chamber")
+	jobs, reports, err := l.Load(ctx, "thepwagner", "echo-chamber")
 	require.NoError(t, err)
+	assert.NotEmpty(t, reports)
 
 	if assert.Len(t, jobs, 1) {
 		job1 := jobs[0]
@@ -25,16 +33,131 @@ func TestLoader_Load(t *testing.T) {
 		assert.Equal(t, job1.Triggers, []flows.Trigger{
 			{Event: "issue_comment", Actions: []string{"created"}},
 		})
-		if assert.Len(t, job1.Steps, 1) {
-			step1 := job1.Steps[0]
+		if assert.Len(t, job1.Steps(), 1) {
+			step1 := job1.Steps()[0]
 			assert.Equal(t, "echo-timer-0", step1.Name)
 			assert.Equal(t, map[string]string{
 				"id":    "Cloud",
 				"token": "${{ secrets.GITHUB_TOKEN }}",
 			}, step1.Inputs)
-			assert.True(t, len(step1.SourceCode) > 1024)
+			assert.Equal(t, "dist/index.js", step1.Main)
+			assert.True(t, len(step1.Files[step1.Main]) > 1024)
+		}
+	}
+}
+
+func TestLoader_LoadSource(t *testing.T) {
+	dir := writeTestRepo(t)
+	defer os.RemoveAll(dir)
+
+	l, err := flows.NewLoader()
+	require.NoError(t, err)
+	jobs, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, "other.yaml", jobs[0].Name)
+		assert.Equal(t, []flows.Trigger{{Event: "push"}}, jobs[0].Triggers)
+	}
+	assert.ElementsMatch(t, []flows.Report{
+		{
+			Workflow: "docker.yml",
+			Steps:    1,
+			Blockers: []flows.Issue{{Step: "hello-0", Kind: "action is not function compatible", Reason: "action is not function compatible"}},
+		},
+		{Workflow: "other.yaml"},
+	}, reports)
+}
+
+func TestLoader_LoadSource_Compatible(t *testing.T) {
+	dir := writeTestRepo(t)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".github", "workflows", "docker.yml"), []byte(`
+on:
+  issue_comment:
+    types: created
+env:
+  GREETING: hello
+jobs:
+  echo-timer:
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: Cloud
+`), 0644))
+
+	lock := flows.NewLockfile()
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()), flows.WithLockfile(lock))
+	require.NoError(t, err)
+	jobs, _, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+
+	var loaded *flows.LoadedFlow
+	for i := range jobs {
+		if jobs[i].Name == "docker.yml" {
+			loaded = &jobs[i]
 		}
 	}
+	require.NotNil(t, loaded)
+	if assert.Len(t, loaded.Steps(), 1) {
+		step := loaded.Steps()[0]
+		assert.Equal(t, echoTimerSHA, step.SHA)
+		assert.Equal(t, "dist/index.js", step.Main)
+		assert.Len(t, step.Files, 2)
+		assert.Equal(t, map[string]string{"id": "Cloud", "token": "${{ github.token }}"}, step.Inputs)
+		assert.Equal(t, map[string]string{"GREETING": "hello"}, step.Env)
+	}
+	if assert.Contains(t, lock.Actions, "thepwagner/echo-timer@master") {
+		locked := lock.Actions["thepwagner/echo-timer@master"]
+		assert.Equal(t, echoTimerSHA, locked.SHA)
+		assert.NotEmpty(t, locked.Hash)
+	}
+}
+
+func TestLoader_LoadSource_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-concurrent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	workflowsDir := filepath.Join(dir, ".github", "workflows")
+	require.NoError(t, os.MkdirAll(workflowsDir, 0755))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, fmt.Sprintf("flow%d.yml", i)), []byte(fakeWorkflow), 0644))
+	}
+
+	src := newFakeActionSource()
+	l, err := flows.NewLoader(flows.WithActionSource(src), flows.WithConcurrency(4))
+	require.NoError(t, err)
+	jobs, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	assert.Len(t, jobs, 10)
+	assert.Len(t, reports, 10)
+	// Every workflow uses the same action, it is only fetched once:
+	assert.Equal(t, 1, src.fetches)
+
+	// Errors cancel the load:
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, "broken.yml"), []byte("on: [push"), 0644))
+	_, _, err = l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	assert.Error(t, err)
+}
+
+func TestLoader_Load_Enterprise(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/repos/thepwagner/echo-chamber/contents/.github/workflows", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"type":"file","name":"docker.yml","path":".github/workflows/docker.yml"}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/thepwagner/echo-chamber/contents/.github/workflows/docker.yml", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"type":"file","encoding":"base64","content":%q}`, base64.StdEncoding.EncodeToString([]byte(dockerWorkflow)))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	l, err := flows.NewLoader(flows.WithBaseURL(srv.URL))
+	require.NoError(t, err)
+	_, reports, err := l.Load(context.Background(), "thepwagner", "echo-chamber")
+	require.NoError(t, err)
+	if assert.Len(t, reports, 1) {
+		assert.Equal(t, "docker.yml", reports[0].Workflow)
+	}
 }
 
 func TestLoader_IsNodeStep(t *testing.T) {
@@ -43,7 +166,8 @@ func TestLoader_IsNodeStep(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	l := flows.NewLoader()
+	l, err := flows.NewLoader()
+	require.NoError(t, err)
 
 	cases := []struct {
 		uses string
@@ -0,0 +1,102 @@
+package flows
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LockfileName is where pinned action references are stored.
+const LockfileName = "fsb.lock"
+
+// Lockfile pins action references to immutable commit SHAs, so redeploys are reproducible.
+type Lockfile struct {
+	// Actions by the step's `uses:`, e.g. "thepwagner/echo-timer@master".
+	Actions map[string]LockedAction `yaml:"actions"`
+
+	// mu guards Actions while loading.
+	mu sync.Mutex
+}
+
+type LockedAction struct {
+	SHA string `yaml:"sha"`
+	// Hash of the fetched action source, see Action.ContentHash.
+	Hash string `yaml:"hash,omitempty"`
+}
+
+func NewLockfile() *Lockfile {
+	return &Lockfile{Actions: map[string]LockedAction{}}
+}
+
+// ReadLockfile loads a lockfile from disk. A missing file is an empty lockfile.
+func ReadLockfile(path string) (*Lockfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewLockfile(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading lockfile: %w", err)
+	}
+
+	lock := NewLockfile()
+	if err := yaml.Unmarshal(b, lock); err != nil {
+		return nil, fmt.Errorf("decoding lockfile: %w", err)
+	}
+	if lock.Actions == nil {
+		lock.Actions = map[string]LockedAction{}
+	}
+	return lock, nil
+}
+
+func (l *Lockfile) get(uses string) (LockedAction, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locked, ok := l.Actions[uses]
+	return locked, ok
+}
+
+func (l *Lockfile) set(uses string, locked LockedAction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Actions[uses] = locked
+}
+
+// checkHash records the content hash of an action, or verifies it matches the recorded hash.
+func (l *Lockfile) checkHash(uses, hash string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locked := l.Actions[uses]
+	if locked.Hash == "" {
+		locked.Hash = hash
+		l.Actions[uses] = locked
+		return nil
+	}
+	if locked.Hash != hash {
+		return fmt.Errorf("content hash mismatch for %q: locked %s, fetched %s", uses, locked.Hash, hash)
+	}
+	return nil
+}
+
+func (l *Lockfile) Write(path string) error {
+	b, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding lockfile: %w", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("writing lockfile: %w", err)
+	}
+	return nil
+}
+
+// Uses returns the pinned action references, sorted.
+func (l *Lockfile) Uses() []string {
+	uses := make([]string, 0, len(l.Actions))
+	for u := range l.Actions {
+		uses = append(uses, u)
+	}
+	sort.Strings(uses)
+	return uses
+}
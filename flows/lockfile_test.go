@@ -0,0 +1,33 @@
+package flows_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestLockfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, flows.LockfileName)
+
+	// Missing lockfile is empty:
+	lock, err := flows.ReadLockfile(path)
+	require.NoError(t, err)
+	assert.Empty(t, lock.Actions)
+
+	lock.Actions["thepwagner/echo-timer@master"] = flows.LockedAction{SHA: "0123456789abcdef0123456789abcdef01234567"}
+	lock.Actions["actions/labeler@v3-preview"] = flows.LockedAction{SHA: "fedcba9876543210fedcba9876543210fedcba98"}
+	require.NoError(t, lock.Write(path))
+
+	reread, err := flows.ReadLockfile(path)
+	require.NoError(t, err)
+	assert.Equal(t, lock.Actions, reread.Actions)
+	assert.Equal(t, []string{"actions/labeler@v3-preview", "thepwagner/echo-timer@master"}, reread.Uses())
+}
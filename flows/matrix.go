@@ -0,0 +1,260 @@
+package flows
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Strategy is a job's `strategy:`.
+type Strategy struct {
+	Matrix Matrix `yaml:"matrix"`
+	// FailFast cancels a job's other instances when one fails, defaulting to true.
+	FailFast *bool `yaml:"fail-fast"`
+	// MaxParallel limits how many instances of a job run at once, unlimited if 0.
+	MaxParallel int `yaml:"max-parallel"`
+}
+
+// FailsFast reports whether the strategy cancels instances after a failure.
+func (s Strategy) FailsFast() bool {
+	return s.FailFast == nil || *s.FailFast
+}
+
+// Matrix is a job's `strategy.matrix:`.
+type Matrix struct {
+	// Expression is set if the matrix (or part of it) is only known at runtime, e.g. `${{ fromJson(...) }}`.
+	Expression string
+	// Dimensions, in the order they were declared.
+	Dimensions []MatrixDimension
+	Include    []map[string]string
+	Exclude    []map[string]string
+	// Unsupported describes parts of the matrix that can't be expanded, e.g. object values.
+	Unsupported []string
+}
+
+// MatrixDimension is a key of the matrix, and the values it takes.
+type MatrixDimension struct {
+	Key    string
+	Values []string
+}
+
+func (m *Matrix) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err == nil {
+		m.Expression = expr
+		return nil
+	}
+
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		key := fmt.Sprint(item.Key)
+		if expr, ok := item.Value.(string); ok && strings.Contains(expr, "${{") {
+			m.Expression = expr
+			continue
+		}
+		switch key {
+		case "include", "exclude":
+			entries, err := matrixEntries(item.Value)
+			if err != nil {
+				m.Unsupported = append(m.Unsupported, fmt.Sprintf("%s %v", key, err))
+				continue
+			}
+			if key == "include" {
+				m.Include = entries
+			} else {
+				m.Exclude = entries
+			}
+		default:
+			list, ok := item.Value.([]interface{})
+			if !ok {
+				m.Unsupported = append(m.Unsupported, fmt.Sprintf("%q is not a list", key))
+				continue
+			}
+			dim := MatrixDimension{Key: key}
+			for _, v := range list {
+				s, err := matrixValue(v)
+				if err != nil {
+					m.Unsupported = append(m.Unsupported, fmt.Sprintf("%q %v", key, err))
+					break
+				}
+				dim.Values = append(dim.Values, s)
+			}
+			m.Dimensions = append(m.Dimensions, dim)
+		}
+	}
+	return nil
+}
+
+func matrixEntries(v interface{}) ([]map[string]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("is not a list")
+	}
+	entries := make([]map[string]string, 0, len(list))
+	for _, item := range list {
+		fields, ok := item.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("entry is not a map")
+		}
+		entry := make(map[string]string, len(fields))
+		for _, field := range fields {
+			s, err := matrixValue(field.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%q %w", field.Key, err)
+			}
+			entry[fmt.Sprint(field.Key)] = s
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func matrixValue(v interface{}) (string, error) {
+	switch v.(type) {
+	case string, int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("has object values")
+	}
+}
+
+// Expand returns every combination of the matrix, following GitHub's `include` and `exclude` rules.
+// A job without a matrix has a single, empty combination.
+func (m Matrix) Expand() ([]map[string]string, error) {
+	if m.Expression != "" {
+		return nil, fmt.Errorf("matrix is not static: %s", m.Expression)
+	}
+	if len(m.Unsupported) > 0 {
+		return nil, fmt.Errorf("matrix is not supported: %s", strings.Join(m.Unsupported, ", "))
+	}
+	if len(m.Dimensions) == 0 && len(m.Include) == 0 {
+		return []map[string]string{nil}, nil
+	}
+
+	var combos []map[string]string
+	if len(m.Dimensions) > 0 {
+		combos = []map[string]string{{}}
+		for _, dim := range m.Dimensions {
+			next := make([]map[string]string, 0, len(combos)*len(dim.Values))
+			for _, combo := range combos {
+				for _, v := range dim.Values {
+					c := make(map[string]string, len(combo)+1)
+					for k, cv := range combo {
+						c[k] = cv
+					}
+					c[dim.Key] = v
+					next = append(next, c)
+				}
+			}
+			combos = next
+		}
+	}
+
+	// Exclusions match on every key they specify:
+	filtered := combos[:0]
+	for _, combo := range combos {
+		var excluded bool
+		for _, exclude := range m.Exclude {
+			if matchesEntry(combo, exclude, nil) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			filtered = append(filtered, combo)
+		}
+	}
+	combos = filtered
+
+	// Inclusions extend every combination whose original values they don't overwrite, or are added as a new combination:
+	dims := make(map[string]bool, len(m.Dimensions))
+	for _, dim := range m.Dimensions {
+		dims[dim.Key] = true
+	}
+	original := len(combos)
+	for _, include := range m.Include {
+		var extended bool
+		for _, combo := range combos[:original] {
+			if !matchesEntry(combo, include, dims) {
+				continue
+			}
+			for k, v := range include {
+				combo[k] = v
+			}
+			extended = true
+		}
+		if !extended {
+			c := make(map[string]string, len(include))
+			for k, v := range include {
+				c[k] = v
+			}
+			combos = append(combos, c)
+		}
+	}
+	return combos, nil
+}
+
+// matchesEntry reports whether the combination agrees with every value of entry, limited to keys if not nil.
+func matchesEntry(combo, entry map[string]string, keys map[string]bool) bool {
+	for k, v := range entry {
+		if keys != nil && !keys[k] {
+			continue
+		}
+		if cv, ok := combo[k]; !ok || cv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// InstanceName names the job's instance for a combination, like GitHub: `build (12, ubuntu-latest)`.
+func (m Matrix) InstanceName(job string, combo map[string]string) string {
+	if len(combo) == 0 {
+		return job
+	}
+	var values []string
+	seen := map[string]bool{}
+	for _, dim := range m.Dimensions {
+		if v, ok := combo[dim.Key]; ok {
+			values = append(values, v)
+			seen[dim.Key] = true
+		}
+	}
+	var extra []string
+	for k := range combo {
+		if !seen[k] {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		values = append(values, combo[k])
+	}
+	return fmt.Sprintf("%s (%s)", job, strings.Join(values, ", "))
+}
+
+var contextExprRe = regexp.MustCompile(`\$\{\{\s*([\w-]+)\.([\w-]+)\s*\}\}`)
+
+// resolveContext replaces `${{ <name>.key }}` expressions with values, e.g. `${{ matrix.os }}`.
+// Unknown keys are left as is.
+func resolveContext(v, name string, values map[string]string) string {
+	if len(values) == 0 {
+		return v
+	}
+	return contextExprRe.ReplaceAllStringFunc(v, func(expr string) string {
+		match := contextExprRe.FindStringSubmatch(expr)
+		if match[1] != name {
+			return expr
+		}
+		if value, ok := values[match[2]]; ok {
+			return value
+		}
+		return expr
+	})
+}
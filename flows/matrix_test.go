@@ -0,0 +1,303 @@
+package flows_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+	"gopkg.in/yaml.v2"
+)
+
+func TestStrategy_Decode(t *testing.T) {
+	var job flows.Job
+	require.NoError(t, yaml.Unmarshal([]byte(`
+strategy:
+  fail-fast: false
+  max-parallel: 2
+  matrix:
+    os: [ubuntu-latest, windows-latest]
+    node: [10, 12]
+    include:
+      - os: ubuntu-latest
+        experimental: true
+    exclude:
+      - os: windows-latest
+        node: 10
+`), &job))
+
+	assert.False(t, job.Strategy.FailsFast())
+	assert.Equal(t, 2, job.Strategy.MaxParallel)
+	assert.Equal(t, flows.Matrix{
+		Dimensions: []flows.MatrixDimension{
+			{Key: "os", Values: []string{"ubuntu-latest", "windows-latest"}},
+			{Key: "node", Values: []string{"10", "12"}},
+		},
+		Include: []map[string]string{{"os": "ubuntu-latest", "experimental": "true"}},
+		Exclude: []map[string]string{{"os": "windows-latest", "node": "10"}},
+	}, job.Strategy.Matrix)
+
+	job = flows.Job{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+strategy:
+  matrix: ${{ fromJson(needs.setup.outputs.matrix) }}
+`), &job))
+	assert.True(t, job.Strategy.FailsFast())
+	assert.Equal(t, "${{ fromJson(needs.setup.outputs.matrix) }}", job.Strategy.Matrix.Expression)
+
+	// Object values are decoded, but can't be expanded:
+	job = flows.Job{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+strategy:
+  matrix:
+    config: [{os: ubuntu, node: 14}]
+    include:
+      - site: {id: Cloud}
+`), &job))
+	assert.Equal(t, []string{`"config" has object values`, `include "site" has object values`}, job.Strategy.Matrix.Unsupported)
+	_, err := job.Strategy.Matrix.Expand()
+	assert.EqualError(t, err, `matrix is not supported: "config" has object values, include "site" has object values`)
+}
+
+func TestMatrix_Expand(t *testing.T) {
+	dims := []flows.MatrixDimension{
+		{Key: "os", Values: []string{"linux", "windows"}},
+		{Key: "node", Values: []string{"10", "12"}},
+	}
+	cases := map[string]struct {
+		matrix   flows.Matrix
+		expanded []map[string]string
+	}{
+		"no matrix": {
+			expanded: []map[string]string{nil},
+		},
+		"cartesian": {
+			matrix: flows.Matrix{Dimensions: dims},
+			expanded: []map[string]string{
+				{"os": "linux", "node": "10"},
+				{"os": "linux", "node": "12"},
+				{"os": "windows", "node": "10"},
+				{"os": "windows", "node": "12"},
+			},
+		},
+		"exclude": {
+			matrix: flows.Matrix{Dimensions: dims, Exclude: []map[string]string{{"os": "windows"}}},
+			expanded: []map[string]string{
+				{"os": "linux", "node": "10"},
+				{"os": "linux", "node": "12"},
+			},
+		},
+		"include extends": {
+			matrix: flows.Matrix{Dimensions: dims, Include: []map[string]string{{"node": "12", "npm": "6"}}},
+			expanded: []map[string]string{
+				{"os": "linux", "node": "10"},
+				{"os": "linux", "node": "12", "npm": "6"},
+				{"os": "windows", "node": "10"},
+				{"os": "windows", "node": "12", "npm": "6"},
+			},
+		},
+		"include adds": {
+			matrix: flows.Matrix{
+				Dimensions: dims,
+				Exclude:    []map[string]string{{"os": "windows"}},
+				Include:    []map[string]string{{"os": "windows", "node": "14"}},
+			},
+			expanded: []map[string]string{
+				{"os": "linux", "node": "10"},
+				{"os": "linux", "node": "12"},
+				{"os": "windows", "node": "14"},
+			},
+		},
+		"only include": {
+			matrix: flows.Matrix{Include: []map[string]string{{"site": "a"}, {"site": "b"}}},
+			expanded: []map[string]string{
+				{"site": "a"},
+				{"site": "b"},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			expanded, err := tc.matrix.Expand()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expanded, expanded)
+		})
+	}
+
+	_, err := flows.Matrix{Expression: "${{ fromJson(x) }}"}.Expand()
+	assert.Error(t, err)
+}
+
+func TestMatrix_InstanceName(t *testing.T) {
+	m := flows.Matrix{Dimensions: []flows.MatrixDimension{{Key: "os"}, {Key: "node"}}}
+	assert.Equal(t, "build", m.InstanceName("build", nil))
+	assert.Equal(t, "build (linux, 12, 6)", m.InstanceName("build", map[string]string{"node": "12", "os": "linux", "npm": "6"}))
+}
+
+func TestLoader_LoadSource_Matrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-matrix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	workflowsDir := filepath.Join(dir, ".github", "workflows")
+	require.NoError(t, os.MkdirAll(workflowsDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, "matrix.yml"), []byte(`
+on: push
+jobs:
+  echo:
+    strategy:
+      max-parallel: 1
+      matrix:
+        id: [Cloud, Edge]
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ matrix.id }}
+        env:
+          SITE: site-${{ matrix.id }}
+  dynamic:
+    strategy:
+      matrix: ${{ fromJson(needs.setup.outputs.matrix) }}
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ matrix.id }}
+`), 0644))
+
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+	require.NoError(t, err)
+	loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+	require.Len(t, reports, 1)
+	assert.Equal(t, 2, reports[0].Steps)
+	assert.Equal(t, 2, reports[0].CompatibleSteps)
+	assert.Equal(t, []flows.Issue{
+		{Step: "dynamic", Kind: "matrix is not supported", Reason: "matrix is not static: ${{ fromJson(needs.setup.outputs.matrix) }}"},
+	}, reports[0].Blockers)
+
+	// Without the dynamic job, the matrix job converts:
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, "matrix.yml"), []byte(`
+on: push
+jobs:
+  echo:
+    strategy:
+      max-parallel: 1
+      matrix:
+        id: [Cloud, Edge]
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ matrix.id }}
+        env:
+          SITE: site-${{ matrix.id }}
+`), 0644))
+	loaded, _, err = l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	require.Len(t, loaded[0].Jobs, 1)
+	job := loaded[0].Jobs[0]
+	assert.Equal(t, "echo", job.Name)
+	assert.True(t, job.FailFast)
+	assert.Equal(t, 1, job.MaxParallel)
+	require.Len(t, job.Instances, 2)
+	assert.Equal(t, "echo (Cloud)", job.Instances[0].Name)
+	assert.Equal(t, map[string]string{"id": "Cloud"}, job.Instances[0].Matrix)
+	assert.Equal(t, "echo (Cloud)-0", job.Instances[0].Steps[0].Name)
+	assert.Equal(t, "Cloud", job.Instances[0].Steps[0].Inputs["id"])
+	assert.Equal(t, "site-Edge", job.Instances[1].Steps[0].Env["SITE"])
+
+	// Object values block the workflow, without failing the others:
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, "objects.yml"), []byte(`
+on: push
+jobs:
+  echo:
+    strategy:
+      matrix:
+        config: [{os: ubuntu, node: 14}]
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ matrix.config.os }}
+`), 0644))
+	loaded, reports, err = l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	assert.Equal(t, "matrix.yml", loaded[0].Name)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "objects.yml", reports[1].Workflow)
+	assert.Equal(t, []flows.Issue{
+		{Step: "echo", Kind: "matrix is not supported", Reason: `matrix is not supported: "config" has object values`},
+	}, reports[1].Blockers)
+}
+
+func TestLoader_LoadSource_TimeoutsAndConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-concurrency")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	workflowsDir := filepath.Join(dir, ".github", "workflows")
+	require.NoError(t, os.MkdirAll(workflowsDir, 0755))
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, "wf.yml"), []byte(content), 0644))
+	}
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+	require.NoError(t, err)
+
+	write(`
+on: push
+concurrency: ${{ github.workflow }}-${{ github.ref }}
+jobs:
+  echo:
+    strategy:
+      matrix:
+        id: [Cloud]
+        experimental: [true]
+    concurrency:
+      group: echo-${{ matrix.id }}
+      cancel-in-progress: true
+    continue-on-error: ${{ matrix.experimental }}
+    steps:
+      - uses: thepwagner/echo-timer@master
+        timeout-minutes: 2
+        with:
+          id: ${{ matrix.id }}
+`)
+	loaded, _, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	assert.Equal(t, &flows.Concurrency{Group: "${{ github.workflow }}-${{ github.ref }}"}, loaded[0].Concurrency)
+	require.Len(t, loaded[0].Jobs, 1)
+	instance := loaded[0].Jobs[0].Instances[0]
+	assert.Equal(t, 0.0, instance.TimeoutMinutes)
+	assert.True(t, instance.ContinueOnError)
+	assert.Equal(t, &flows.Concurrency{Group: "echo-Cloud", CancelInProgress: true}, instance.Concurrency)
+	assert.Equal(t, 2.0, instance.Steps[0].TimeoutMinutes)
+	assert.False(t, instance.Steps[0].ContinueOnError)
+
+	write(`
+on: push
+concurrency: ${{ needs.setup.outputs.group }}
+jobs:
+  echo:
+    timeout-minutes: ${{ fromJson(vars.T) }}
+    steps:
+      - uses: thepwagner/echo-timer@master
+        timeout-minutes: ${{ fromJson(vars.T) }}
+        continue-on-error: ${{ steps.x.outcome == 'failure' }}
+        with:
+          id: Cloud
+`)
+	loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+	require.Len(t, reports, 1)
+	assert.Equal(t, []flows.Issue{
+		{Step: "concurrency", Kind: "concurrency group uses unsupported expressions", Reason: `concurrency group "${{ needs.setup.outputs.group }}" uses unsupported expressions`},
+		{Step: "echo", Kind: "timeout-minutes is not static", Reason: `timeout-minutes "${{ fromJson(vars.T) }}" is not static`},
+		{Step: "echo-0", Kind: "timeout-minutes is not static", Reason: `timeout-minutes "${{ fromJson(vars.T) }}" is not static`},
+		{Step: "echo-0", Kind: "continue-on-error is not static", Reason: `continue-on-error "${{ steps.x.outcome == 'failure' }}" is not static`},
+	}, reports[0].Blockers)
+}
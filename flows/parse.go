@@ -1,28 +1,92 @@
 package flows
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 type Workflow struct {
-	On   interface{}     `yaml:"on"`
-	Jobs map[string]*Job `yaml:"jobs"`
+	On          interface{}       `yaml:"on"`
+	Env         map[string]string `yaml:"env"`
+	Concurrency *Concurrency      `yaml:"concurrency"`
+	Jobs        map[string]*Job   `yaml:"jobs"`
 }
 
 type Job struct {
-	Steps []Step `yaml:"steps"`
+	Env      map[string]string `yaml:"env"`
+	Strategy Strategy          `yaml:"strategy"`
+	Steps    []Step            `yaml:"steps"`
+	// TimeoutMinutes is empty if unset, GitHub then applies DefaultTimeoutMinutes. It may be an expression, e.g. `${{ fromJson(vars.T) }}`.
+	TimeoutMinutes string `yaml:"timeout-minutes"`
+	// ContinueOnError is "true", "false" or an expression, e.g. `${{ matrix.experimental }}`.
+	ContinueOnError string       `yaml:"continue-on-error"`
+	Concurrency     *Concurrency `yaml:"concurrency"`
+	// Uses calls a reusable workflow instead of running steps, e.g. `octo-org/ci/.github/workflows/build.yml@v1`.
+	Uses    string            `yaml:"uses"`
+	With    map[string]string `yaml:"with"`
+	Secrets JobSecrets        `yaml:"secrets"`
 }
 
 type Step struct {
-	Uses string            `yaml:"uses"`
-	With map[string]string `yaml:"with"`
+	ID              string            `yaml:"id"`
+	Uses            string            `yaml:"uses"`
+	With            map[string]string `yaml:"with"`
+	Env             map[string]string `yaml:"env"`
+	TimeoutMinutes  string            `yaml:"timeout-minutes"`
+	ContinueOnError string            `yaml:"continue-on-error"`
 }
 
+// DefaultTimeoutMinutes is how long GitHub lets a job run.
+const DefaultTimeoutMinutes = 360
+
+// Concurrency is a `concurrency:` group, given as the group name or a map.
+type Concurrency struct {
+	Group            string `yaml:"group" json:"group"`
+	CancelInProgress bool   `yaml:"cancel-in-progress" json:"cancelInProgress"`
+}
+
+func (c *Concurrency) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var group string
+	if err := unmarshal(&group); err == nil {
+		c.Group = group
+		return nil
+	}
+	type concurrency Concurrency
+	return unmarshal((*concurrency)(c))
+}
+
+// Action is the metadata of an action, from `action.yml`.
 type Action struct {
-	Runs       Runs   `yaml:"runs"`
-	SourceCode string `yaml:"-"`
+	Name        string                  `yaml:"name"`
+	Description string                  `yaml:"description"`
+	Inputs      map[string]ActionInput  `yaml:"inputs"`
+	Outputs     map[string]ActionOutput `yaml:"outputs"`
+	Branding    Branding                `yaml:"branding"`
+	Runs        Runs                    `yaml:"runs"`
+	// SHA is the commit the metadata was fetched from.
+	SHA string `yaml:"-"`
+	// Files of the action's bundle, by path within the action repository.
+	Files map[string][]byte `yaml:"-"`
+}
+
+type ActionInput struct {
+	Description        string `yaml:"description"`
+	Required           bool   `yaml:"required"`
+	Default            string `yaml:"default"`
+	DeprecationMessage string `yaml:"deprecationMessage"`
+}
+
+type ActionOutput struct {
+	Description string `yaml:"description"`
+}
+
+type Branding struct {
+	Icon  string `yaml:"icon"`
+	Color string `yaml:"color"`
 }
 
 type Runs struct {
@@ -35,6 +99,10 @@ func (w Workflow) Triggers() ([]Trigger, error) {
 	switch on := w.On.(type) {
 	case string:
 		t = append(t, Trigger{Event: on})
+	case []interface{}:
+		for _, event := range on {
+			t = append(t, Trigger{Event: fmt.Sprint(event)})
+		}
 	case map[interface{}]interface{}:
 		for event, details := range on {
 			trigger := Trigger{Event: event.(string)}
@@ -45,6 +113,10 @@ func (w Workflow) Triggers() ([]Trigger, error) {
 						trigger.Actions = []string{actions}
 					case []string:
 						trigger.Actions = actions
+					case []interface{}:
+						for _, action := range actions {
+							trigger.Actions = append(trigger.Actions, fmt.Sprint(action))
+						}
 					default:
 						return nil, fmt.Errorf("unexpected `types` type: %T", actions)
 					}
@@ -58,6 +130,75 @@ func (w Workflow) Triggers() ([]Trigger, error) {
 	return t, nil
 }
 
+// MergeEnv combines `env:` blocks, later levels take precedence (e.g. workflow, job, step).
+func MergeEnv(levels ...map[string]string) map[string]string {
+	env := map[string]string{}
+	for _, level := range levels {
+		for k, v := range level {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// ApplyInputs merges a step's `with:` over the action's input defaults.
+// Returns an error if a required input without a default is not provided.
+func (a Action) ApplyInputs(with map[string]string) (map[string]string, error) {
+	inputs := make(map[string]string, len(with))
+	provided := make(map[string]struct{}, len(with))
+	for k, v := range with {
+		inputs[k] = v
+		provided[strings.ToLower(k)] = struct{}{}
+	}
+
+	for name, input := range a.Inputs {
+		if _, ok := provided[strings.ToLower(name)]; ok {
+			continue
+		}
+		if input.Default != "" {
+			inputs[name] = input.Default
+			continue
+		}
+		if input.Required {
+			return nil, fmt.Errorf("missing required input %q", name)
+		}
+	}
+	return inputs, nil
+}
+
+// Deprecations returns a warning for each deprecated input provided by a step's `with:`.
+func (a Action) Deprecations(with map[string]string) []string {
+	var warnings []string
+	for name, input := range a.Inputs {
+		if input.DeprecationMessage == "" {
+			continue
+		}
+		for k := range with {
+			if strings.EqualFold(k, name) {
+				warnings = append(warnings, fmt.Sprintf("input %q is deprecated: %s", name, input.DeprecationMessage))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// ContentHash identifies the action's code, to detect changes to pinned actions.
+func (a Action) ContentHash() string {
+	paths := make([]string, 0, len(a.Files))
+	for p := range a.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for _, p := range paths {
+		fileHash := sha256.Sum256(a.Files[p])
+		_, _ = fmt.Fprintf(hash, "%s  %s\n", hex.EncodeToString(fileHash[:]), p)
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
 func (a Action) FunctionCompatible() bool {
 	return a.Runs.Using == "node12" && strings.HasPrefix(a.Runs.Main, "dist/")
 }
@@ -70,6 +211,11 @@ type ActionReference struct {
 	Ref       string
 }
 
+// Repo is the action's repository, e.g. "actions/labeler".
+func (r ActionReference) Repo() string {
+	return fmt.Sprintf("%s/%s", r.RepoOwner, r.RepoName)
+}
+
 func ParseActionReference(stepUses string) (ActionReference, bool) {
 	// TODO: non-root paths
 	// TODO: relative path in this repo
@@ -41,6 +41,92 @@ jobs:
 	}
 }
 
+func TestDecode_Env(t *testing.T) {
+	const data = `
+on: push
+env:
+  LEVEL: workflow
+  WORKFLOW_ONLY: true
+jobs:
+  build:
+    env:
+      LEVEL: job
+      JOB_ONLY: 1
+    steps:
+      - uses: thepwagner/echo-timer@master
+        env:
+          LEVEL: step
+`
+
+	var wf flows.Workflow
+	err := yaml.NewDecoder(strings.NewReader(data)).Decode(&wf)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"LEVEL": "workflow", "WORKFLOW_ONLY": "true"}, wf.Env)
+	require.Contains(t, wf.Jobs, "build")
+	job := wf.Jobs["build"]
+	assert.Equal(t, map[string]string{"LEVEL": "job", "JOB_ONLY": "1"}, job.Env)
+	require.Len(t, job.Steps, 1)
+	assert.Equal(t, map[string]string{
+		"LEVEL":         "step",
+		"WORKFLOW_ONLY": "true",
+		"JOB_ONLY":      "1",
+	}, flows.MergeEnv(wf.Env, job.Env, job.Steps[0].Env))
+}
+
+func TestDecodeAction(t *testing.T) {
+	const data = `
+name: Echo Timer
+description: Replies to comments, quickly
+inputs:
+  id:
+    description: Identifier to reply with
+    required: true
+  token:
+    description: GitHub token
+    required: true
+    default: ${{ github.token }}
+  verbose:
+    description: Log more
+    deprecationMessage: Use debug logging instead
+outputs:
+  reply-id:
+    description: ID of the reply comment
+branding:
+  icon: clock
+  color: green
+runs:
+  using: node12
+  main: dist/index.js
+`
+
+	var action flows.Action
+	err := yaml.Unmarshal([]byte(data), &action)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Echo Timer", action.Name)
+	assert.Equal(t, "Replies to comments, quickly", action.Description)
+	assert.Equal(t, flows.ActionInput{Description: "Identifier to reply with", Required: true}, action.Inputs["id"])
+	assert.Equal(t, "${{ github.token }}", action.Inputs["token"].Default)
+	assert.Contains(t, action.Outputs, "reply-id")
+	assert.Equal(t, flows.Branding{Icon: "clock", Color: "green"}, action.Branding)
+	assert.True(t, action.FunctionCompatible())
+
+	inputs, err := action.ApplyInputs(map[string]string{"ID": "Cloud"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ID":    "Cloud",
+		"token": "${{ github.token }}",
+	}, inputs)
+
+	_, err = action.ApplyInputs(map[string]string{})
+	assert.EqualError(t, err, `missing required input "id"`)
+
+	assert.Empty(t, action.Deprecations(map[string]string{"id": "Cloud"}))
+	assert.Equal(t, []string{`input "verbose" is deprecated: Use debug logging instead`},
+		action.Deprecations(map[string]string{"id": "Cloud", "verbose": "true"}))
+}
+
 func TestParseActionReference(t *testing.T) {
 	cases := []struct {
 		uses     string
@@ -79,3 +165,44 @@ func TestParseActionReference(t *testing.T) {
 		assert.Equal(t, tc.expected.Ref, actual.Ref)
 	}
 }
+
+func TestAction_ContentHash(t *testing.T) {
+	action := flows.Action{Files: map[string][]byte{
+		"dist/index.js":    []byte("require('./37.index.js')"),
+		"dist/37.index.js": []byte("module.exports = 37"),
+	}}
+	hash := action.ContentHash()
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", hash)
+
+	action.Files["dist/37.index.js"] = []byte("module.exports = 42")
+	assert.NotEqual(t, hash, action.ContentHash())
+}
+
+func TestDecode_Concurrency(t *testing.T) {
+	const data = `
+on: push
+concurrency: deploy-${{ github.ref }}
+jobs:
+  build:
+    timeout-minutes: 5
+    continue-on-error: true
+    concurrency:
+      group: build
+      cancel-in-progress: true
+    steps:
+      - uses: thepwagner/echo-timer@master
+        timeout-minutes: 1.5
+        continue-on-error: ${{ matrix.experimental }}
+`
+
+	var wf flows.Workflow
+	require.NoError(t, yaml.Unmarshal([]byte(data), &wf))
+	assert.Equal(t, &flows.Concurrency{Group: "deploy-${{ github.ref }}"}, wf.Concurrency)
+	job := wf.Jobs["build"]
+	assert.Equal(t, &flows.Concurrency{Group: "build", CancelInProgress: true}, job.Concurrency)
+	assert.Equal(t, "5", job.TimeoutMinutes)
+	assert.Equal(t, "true", job.ContinueOnError)
+	require.Len(t, job.Steps, 1)
+	assert.Equal(t, "1.5", job.Steps[0].TimeoutMinutes)
+	assert.Equal(t, "${{ matrix.experimental }}", job.Steps[0].ContinueOnError)
+}
@@ -0,0 +1,64 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v30/github"
+)
+
+// ErrActionNotAllowed is returned when an action violates the ActionPolicy.
+var ErrActionNotAllowed = errors.New("action not allowed by policy")
+
+// ActionPolicy restricts which actions may be deployed.
+type ActionPolicy struct {
+	// AllowOwners, if not empty, are the only owners whose actions may be used.
+	AllowOwners []string
+	// DenyOwners may never be used, even if allowed.
+	DenyOwners []string
+	// RequireVerified requires refs to be a signed tag, or a verified commit.
+	RequireVerified bool
+}
+
+// Allows returns an error wrapping ErrActionNotAllowed if the action's owner is not permitted.
+func (p ActionPolicy) Allows(ref ActionReference) error {
+	for _, owner := range p.DenyOwners {
+		if strings.EqualFold(owner, ref.RepoOwner) {
+			return fmt.Errorf("%w: owner %q is denied", ErrActionNotAllowed, ref.RepoOwner)
+		}
+	}
+	if len(p.AllowOwners) == 0 {
+		return nil
+	}
+	for _, owner := range p.AllowOwners {
+		if strings.EqualFold(owner, ref.RepoOwner) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: owner %q is not allowed", ErrActionNotAllowed, ref.RepoOwner)
+}
+
+// verifyRef checks the pinned SHA is a signed tag, or a verified commit.
+func verifyRef(ctx context.Context, gh *github.Client, ref ActionReference, sha string) error {
+	tagRef, _, err := gh.Git.GetRef(ctx, ref.RepoOwner, ref.RepoName, "tags/"+ref.Ref)
+	if err == nil && tagRef.GetObject().GetType() == "tag" {
+		tag, _, err := gh.Git.GetTag(ctx, ref.RepoOwner, ref.RepoName, tagRef.GetObject().GetSHA())
+		if err != nil {
+			return fmt.Errorf("fetching tag: %w", err)
+		}
+		if tag.GetVerification().GetVerified() && tag.GetObject().GetSHA() == sha {
+			return nil
+		}
+	}
+
+	commit, _, err := gh.Git.GetCommit(ctx, ref.RepoOwner, ref.RepoName, sha)
+	if err != nil {
+		return fmt.Errorf("fetching commit: %w", err)
+	}
+	if commit.GetVerification().GetVerified() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is neither a signed tag nor a verified commit", ErrActionNotAllowed, sha)
+}
@@ -0,0 +1,93 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v30/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionPolicy_Allows(t *testing.T) {
+	echoTimer := ActionReference{RepoOwner: "thepwagner", RepoName: "echo-timer", Ref: "master"}
+	labeler := ActionReference{RepoOwner: "actions", RepoName: "labeler", Ref: "v2"}
+
+	cases := map[string]struct {
+		policy  ActionPolicy
+		allowed []ActionReference
+		denied  []ActionReference
+	}{
+		"empty": {
+			allowed: []ActionReference{echoTimer, labeler},
+		},
+		"allowlist": {
+			policy:  ActionPolicy{AllowOwners: []string{"Actions"}},
+			allowed: []ActionReference{labeler},
+			denied:  []ActionReference{echoTimer},
+		},
+		"denylist": {
+			policy:  ActionPolicy{DenyOwners: []string{"thepwagner"}},
+			allowed: []ActionReference{labeler},
+			denied:  []ActionReference{echoTimer},
+		},
+		"deny wins": {
+			policy: ActionPolicy{AllowOwners: []string{"actions"}, DenyOwners: []string{"actions"}},
+			denied: []ActionReference{echoTimer, labeler},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, ref := range tc.allowed {
+				assert.NoError(t, tc.policy.Allows(ref), ref.RepoOwner)
+			}
+			for _, ref := range tc.denied {
+				assert.True(t, errors.Is(tc.policy.Allows(ref), ErrActionNotAllowed), ref.RepoOwner)
+			}
+		})
+	}
+}
+
+func TestVerifyRef(t *testing.T) {
+	const (
+		commitSHA = "0123456789abcdef0123456789abcdef01234567"
+		tagSHA    = "fedcba9876543210fedcba9876543210fedcba98"
+	)
+	var commitVerified, tagVerified bool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/actions/labeler/git/refs/tags/v2", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"ref":"refs/tags/v2","object":{"type":"tag","sha":%q}}`, tagSHA)
+	})
+	mux.HandleFunc("/repos/actions/labeler/git/tags/"+tagSHA, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"sha":%q,"object":{"type":"commit","sha":%q},"verification":{"verified":%t}}`, tagSHA, commitSHA, tagVerified)
+	})
+	mux.HandleFunc("/repos/actions/labeler/git/commits/"+commitSHA, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"sha":%q,"verification":{"verified":%t}}`, commitSHA, commitVerified)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	gh := github.NewClient(srv.Client())
+	gh.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	ctx := context.Background()
+	ref := ActionReference{RepoOwner: "actions", RepoName: "labeler", Ref: "v2"}
+
+	err := verifyRef(ctx, gh, ref, commitSHA)
+	assert.True(t, errors.Is(err, ErrActionNotAllowed))
+
+	tagVerified = true
+	require.NoError(t, verifyRef(ctx, gh, ref, commitSHA))
+	// A signed tag that doesn't point at the pinned SHA isn't enough:
+	assert.Error(t, verifyRef(ctx, gh, ActionReference{RepoOwner: "actions", RepoName: "labeler", Ref: "v2"}, "0000000000000000000000000000000000000000"))
+
+	tagVerified = false
+	commitVerified = true
+	require.NoError(t, verifyRef(ctx, gh, ref, commitSHA))
+}
@@ -0,0 +1,123 @@
+package flows
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Report describes whether a workflow can be ported to AzureFunctions.
+type Report struct {
+	Workflow string
+	// Steps in the workflow, and how many of them can be converted.
+	Steps           int
+	CompatibleSteps int
+	// Actions (e.g. "actions/labeler") used by the compatible steps.
+	Actions []string
+	// Blockers prevent the workflow from being converted.
+	Blockers []Issue
+	// Warnings do not prevent conversion, but deserve attention.
+	Warnings []Issue
+	// History of the workflow on GitHub Actions runners, if sampled.
+	History *RunHistory `json:",omitempty"`
+}
+
+// Issue is a problem found in a step of a workflow.
+type Issue struct {
+	Step string
+	// Kind is a stable category of the issue, e.g. "uses interpolation", for aggregating reports.
+	Kind string
+	// Reason describes the issue, with the specific values involved.
+	Reason string
+}
+
+func (r Report) Compatible() bool {
+	return len(r.Blockers) == 0
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s", i.Step, i.Reason)
+}
+
+var stepOutputRe = regexp.MustCompile(`steps\.([\w-]+)\.outputs\.([\w-]+)`)
+
+// expressionIssues returns blockers for expressions in a step's values.
+// References to step outputs are validated against the outputs declared by previous steps.
+func expressionIssues(stepName string, outputs map[string]map[string]ActionOutput, values ...map[string]string) []Issue {
+	var issues []Issue
+	var interpolation bool
+	for _, vals := range values {
+		keys := make([]string, 0, len(vals))
+		for k := range vals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := vals[k]
+			if !interpolated(v) {
+				continue
+			}
+			interpolation = true
+
+			for _, match := range stepOutputRe.FindAllStringSubmatch(v, -1) {
+				stepID, output := match[1], match[2]
+				declared, ok := outputs[stepID]
+				if !ok {
+					issues = append(issues, Issue{Step: stepName, Kind: "references an unknown step", Reason: fmt.Sprintf("references unknown step %q", stepID)})
+					continue
+				}
+				if _, ok := declared[output]; !ok {
+					issues = append(issues, Issue{Step: stepName, Kind: "references an undeclared output", Reason: fmt.Sprintf("references undeclared output %q of step %q", output, stepID)})
+				}
+			}
+		}
+	}
+	if interpolation {
+		issues = append(issues, Issue{Step: stepName, Kind: "uses interpolation", Reason: "uses interpolation"})
+	}
+	return issues
+}
+
+// staticBool parses a boolean known at load time, e.g. `continue-on-error`, returning an issue for expressions.
+func staticBool(stepName, key, v string) (bool, []Issue) {
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, []Issue{{Step: stepName, Kind: key + " is not static", Reason: fmt.Sprintf("%s %q is not static", key, v)}}
+	}
+	return b, nil
+}
+
+// staticMinutes parses a duration in minutes known at load time, e.g. `timeout-minutes`, returning an issue for expressions.
+func staticMinutes(stepName, key, v string) (float64, []Issue) {
+	if v == "" {
+		return 0, nil
+	}
+	minutes, err := strconv.ParseFloat(v, 64)
+	if err != nil || minutes < 0 {
+		return 0, []Issue{{Step: stepName, Kind: key + " is not static", Reason: fmt.Sprintf("%s %q is not static", key, v)}}
+	}
+	return minutes, nil
+}
+
+var githubExprRe = regexp.MustCompile(`\$\{\{\s*github\.[\w.-]+\s*\}\}`)
+
+// concurrencyIssues returns blockers for concurrency groups the runtime can not resolve.
+// Only `${{ github.* }}` expressions are resolved per delivery.
+func concurrencyIssues(stepName string, c *Concurrency) []Issue {
+	if c == nil {
+		return nil
+	}
+	if c.Group == "" {
+		return []Issue{{Step: stepName, Kind: "concurrency group is empty", Reason: "concurrency group is empty"}}
+	}
+	if strings.Contains(githubExprRe.ReplaceAllString(c.Group, ""), "${{") {
+		return []Issue{{Step: stepName, Kind: "concurrency group uses unsupported expressions", Reason: fmt.Sprintf("concurrency group %q uses unsupported expressions", c.Group)}}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package flows
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressionIssues(t *testing.T) {
+	outputs := map[string]map[string]ActionOutput{
+		"timer": {"reply-id": {Description: "ID of the reply comment"}},
+	}
+
+	cases := map[string]struct {
+		values   map[string]string
+		expected []Issue
+	}{
+		"static": {
+			values: map[string]string{"id": "Cloud"},
+		},
+		"token": {
+			values: map[string]string{"token": "${{ secrets.GITHUB_TOKEN }}"},
+		},
+		"declared output": {
+			values: map[string]string{"id": "${{ steps.timer.outputs.reply-id }}"},
+			expected: []Issue{
+				{Step: "test-1", Kind: "uses interpolation", Reason: "uses interpolation"},
+			},
+		},
+		"undeclared output": {
+			values: map[string]string{"id": "${{ steps.timer.outputs.nope }}"},
+			expected: []Issue{
+				{Step: "test-1", Kind: "references an undeclared output", Reason: `references undeclared output "nope" of step "timer"`},
+				{Step: "test-1", Kind: "uses interpolation", Reason: "uses interpolation"},
+			},
+		},
+		"unknown step": {
+			values: map[string]string{"id": "${{ steps.nope.outputs.reply-id }}"},
+			expected: []Issue{
+				{Step: "test-1", Kind: "references an unknown step", Reason: `references unknown step "nope"`},
+				{Step: "test-1", Kind: "uses interpolation", Reason: "uses interpolation"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			issues := expressionIssues("test-1", outputs, tc.values)
+			assert.Equal(t, tc.expected, issues)
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package flows
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v30/github"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// WorkflowCall is the interface of a reusable workflow, from `on: workflow_call`.
+type WorkflowCall struct {
+	Inputs  map[string]WorkflowCallInput  `yaml:"inputs"`
+	Secrets map[string]WorkflowCallSecret `yaml:"secrets"`
+	Outputs map[string]WorkflowCallOutput `yaml:"outputs"`
+}
+
+type WorkflowCallInput struct {
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+	// Type is one of "boolean", "number" or "string".
+	Type    string `yaml:"type"`
+	Default string `yaml:"default"`
+}
+
+type WorkflowCallSecret struct {
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+}
+
+type WorkflowCallOutput struct {
+	Description string `yaml:"description"`
+	Value       string `yaml:"value"`
+}
+
+const workflowCallEvent = "workflow_call"
+
+// Call returns the workflow's `on: workflow_call`, if it is reusable.
+func (w Workflow) Call() (WorkflowCall, bool, error) {
+	var call WorkflowCall
+	switch on := w.On.(type) {
+	case string:
+		return call, on == workflowCallEvent, nil
+	case []interface{}:
+		for _, event := range on {
+			if event == workflowCallEvent {
+				return call, true, nil
+			}
+		}
+	case map[interface{}]interface{}:
+		details, ok := on[workflowCallEvent]
+		if !ok {
+			return call, false, nil
+		}
+		// Round trip the untyped `on:` into the typed interface:
+		b, err := yaml.Marshal(details)
+		if err != nil {
+			return call, false, err
+		}
+		if err := yaml.Unmarshal(b, &call); err != nil {
+			return call, false, fmt.Errorf("decoding workflow_call: %w", err)
+		}
+		return call, true, nil
+	}
+	return call, false, nil
+}
+
+// JobSecrets are the secrets passed to a reusable workflow, either explicitly or inherited.
+type JobSecrets struct {
+	Inherit bool
+	Values  map[string]string
+}
+
+func (s *JobSecrets) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var inherit string
+	if err := unmarshal(&inherit); err == nil {
+		if inherit != "inherit" {
+			return fmt.Errorf("unexpected secrets %q", inherit)
+		}
+		s.Inherit = true
+		return nil
+	}
+	return unmarshal(&s.Values)
+}
+
+// maxWorkflowDepth is how deeply GitHub allows reusable workflows to be nested.
+const maxWorkflowDepth = 4
+
+// workflowJob is a job to load, after inlining reusable workflows.
+type workflowJob struct {
+	name string
+	job  *Job
+	// env of the workflow declaring the job, the caller's env is not passed to reusable workflows.
+	env map[string]string
+}
+
+// workflowReader reads a workflow file from the repository declaring a workflow, for `./` references.
+type workflowReader func(ctx context.Context, path string) ([]byte, error)
+
+// workflowJobs lists the jobs of a workflow, replacing jobs that call a reusable workflow with the called workflow's jobs.
+// Calls that can not be inlined are recorded as blockers.
+func (l *Loader) workflowJobs(ctx context.Context, logger logrus.FieldLogger, report *Report, read workflowReader, flow Workflow, prefix string, depth int) ([]workflowJob, error) {
+	names := make([]string, 0, len(flow.Jobs))
+	for name := range flow.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var jobs []workflowJob
+	for _, name := range names {
+		job := flow.Jobs[name]
+		jobName := prefix + name
+		if job.Uses == "" {
+			jobs = append(jobs, workflowJob{name: jobName, job: job, env: flow.Env})
+			continue
+		}
+
+		jobLogger := logger.WithFields(logrus.Fields{"job": jobName, "uses": job.Uses})
+		blocker := func(kind, reason string) {
+			jobLogger.Info(reason)
+			report.Blockers = append(report.Blockers, Issue{Step: jobName, Kind: kind, Reason: reason})
+		}
+		if depth >= maxWorkflowDepth {
+			blocker("reusable workflows are nested too deeply", "reusable workflows are nested too deeply")
+			continue
+		}
+		m := job.Strategy.Matrix
+		if m.Expression != "" || len(m.Dimensions) > 0 || len(m.Include) > 0 {
+			blocker("matrix calls of reusable workflows are not supported", "matrix calls of reusable workflows are not supported")
+			continue
+		}
+
+		called, calledRead, err := l.loadCalledWorkflow(ctx, read, job.Uses)
+		if errors.Is(err, ErrActionNotAllowed) {
+			blocker(ErrActionNotAllowed.Error(), err.Error())
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("loading reusable workflow %q: %w", job.Uses, err)
+		}
+		call, ok, err := called.Call()
+		if err != nil {
+			return nil, fmt.Errorf("loading reusable workflow %q: %w", job.Uses, err)
+		}
+		if !ok {
+			blocker("workflow is not reusable", fmt.Sprintf("%s is not a reusable workflow", job.Uses))
+			continue
+		}
+		if called.Concurrency != nil {
+			// The group would span the called workflow's jobs, which run as jobs of the caller:
+			blocker("concurrency of reusable workflows is not supported", "concurrency of reusable workflows is not supported")
+			continue
+		}
+		if issues := callIssues(jobName, job, call, called); len(issues) > 0 {
+			jobLogger.Info("Reusable workflow call is invalid")
+			report.Blockers = append(report.Blockers, issues...)
+			continue
+		}
+		jobLogger.Debug("Inlining reusable workflow")
+
+		inputs := callInputs(call, job.With)
+		env := resolveContexts(called.Env, "inputs", inputs)
+		if !job.Secrets.Inherit {
+			env = resolveContexts(env, "secrets", job.Secrets.Values)
+		}
+		inlined := Workflow{On: called.On, Env: env, Jobs: make(map[string]*Job, len(called.Jobs))}
+		for innerName, inner := range called.Jobs {
+			inner = inner.withContext("inputs", inputs)
+			if !job.Secrets.Inherit {
+				inner = inner.withContext("secrets", job.Secrets.Values)
+			}
+			inlined.Jobs[innerName] = inner
+		}
+		innerJobs, err := l.workflowJobs(ctx, logger, report, calledRead, inlined, jobName+"/", depth+1)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, innerJobs...)
+	}
+	return jobs, nil
+}
+
+var reusableWorkflowRe = regexp.MustCompile(`^([^/]+)/([^/]+)/(\.github/workflows/[^@]+)@(.+)$`)
+
+// loadCalledWorkflow reads and parses a reusable workflow, and a reader for its repository.
+// Remote workflows are pinned in the lockfile like actions.
+func (l *Loader) loadCalledWorkflow(ctx context.Context, read workflowReader, uses string) (Workflow, workflowReader, error) {
+	var content []byte
+	var err error
+	if strings.HasPrefix(uses, "./") {
+		if read == nil {
+			return Workflow{}, nil, fmt.Errorf("local workflows can not be read from this source")
+		}
+		content, err = read(ctx, path.Clean(uses))
+	} else {
+		match := reusableWorkflowRe.FindStringSubmatch(uses)
+		if match == nil {
+			return Workflow{}, nil, fmt.Errorf("invalid reusable workflow reference")
+		}
+		ref := ActionReference{RepoOwner: match[1], RepoName: match[2], Ref: match[4]}
+		if err := l.policy.Allows(ref); err != nil {
+			return Workflow{}, nil, err
+		}
+		var sha interface{}
+		sha, err = l.refs.do(ctx, uses, func(ctx context.Context) (interface{}, error) {
+			return l.resolveRef(ctx, uses, ref)
+		})
+		if err != nil {
+			return Workflow{}, nil, fmt.Errorf("resolving workflow ref: %w", err)
+		}
+		read = l.remoteWorkflowReader(ref, sha.(string))
+		content, err = read(ctx, match[3])
+		if err == nil {
+			sum := sha256.Sum256(content)
+			err = l.lock.checkHash(uses, "sha256:"+hex.EncodeToString(sum[:]))
+		}
+	}
+	if err != nil {
+		return Workflow{}, nil, err
+	}
+
+	var flow Workflow
+	if err := yaml.Unmarshal(content, &flow); err != nil {
+		return Workflow{}, nil, fmt.Errorf("decoding workflow: %w", err)
+	}
+	return flow, read, nil
+}
+
+// sourceWorkflowReader reads files of a lazySource, bounded by the loader's concurrency.
+func (l *Loader) sourceWorkflowReader(src lazySource) workflowReader {
+	return func(ctx context.Context, filePath string) ([]byte, error) {
+		content, err := l.workflowFiles.do(ctx, fmt.Sprintf("%s:%s", src, filePath), func(ctx context.Context) (interface{}, error) {
+			select {
+			case l.fetchSem <- struct{}{}:
+				defer func() { <-l.fetchSem }()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return src.readWorkflow(ctx, filePath)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return content.([]byte), nil
+	}
+}
+
+// remoteWorkflowReader reads files of a repository at a commit.
+func (l *Loader) remoteWorkflowReader(ref ActionReference, sha string) workflowReader {
+	return func(ctx context.Context, filePath string) ([]byte, error) {
+		key := fmt.Sprintf("%s@%s:%s", ref.Repo(), sha, filePath)
+		content, err := l.workflowFiles.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+			select {
+			case l.fetchSem <- struct{}{}:
+				defer func() { <-l.fetchSem }()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			file, _, _, err := l.gh.Repositories.GetContents(ctx, ref.RepoOwner, ref.RepoName, filePath, &github.RepositoryContentGetOptions{Ref: sha})
+			if err != nil {
+				return nil, fmt.Errorf("fetching %q: %w", filePath, err)
+			}
+			s, err := file.GetContent()
+			if err != nil {
+				return nil, fmt.Errorf("decoding %q: %w", filePath, err)
+			}
+			return []byte(s), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return content.([]byte), nil
+	}
+}
+
+var jobOutputRe = regexp.MustCompile(`jobs\.([\w-]+)\.outputs\.`)
+
+// callIssues validates a job's call against the reusable workflow's interface.
+func callIssues(jobName string, job *Job, call WorkflowCall, called Workflow) []Issue {
+	var issues []Issue
+	issue := func(kind, format string, args ...interface{}) {
+		issues = append(issues, Issue{Step: jobName, Kind: kind, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	for name, v := range job.With {
+		input, ok := call.Inputs[name]
+		if !ok {
+			issue("reusable workflow has no such input", "reusable workflow has no input %q", name)
+			continue
+		}
+		if strings.Contains(v, "${{") {
+			continue
+		}
+		switch input.Type {
+		case "boolean":
+			if v != "true" && v != "false" {
+				issue("input is not a boolean", "input %q is not a boolean: %q", name, v)
+			}
+		case "number":
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				issue("input is not a number", "input %q is not a number: %q", name, v)
+			}
+		}
+	}
+	for name, input := range call.Inputs {
+		if _, ok := job.With[name]; !ok && input.Required {
+			issue("missing required input", "missing required input %q", name)
+		}
+	}
+
+	if !job.Secrets.Inherit {
+		for name := range job.Secrets.Values {
+			if _, ok := call.Secrets[name]; !ok {
+				issue("reusable workflow has no such secret", "reusable workflow has no secret %q", name)
+			}
+		}
+		for name, secret := range call.Secrets {
+			if _, ok := job.Secrets.Values[name]; !ok && secret.Required {
+				issue("missing required secret", "missing required secret %q", name)
+			}
+		}
+	}
+
+	for name, output := range call.Outputs {
+		for _, match := range jobOutputRe.FindAllStringSubmatch(output.Value, -1) {
+			if _, ok := called.Jobs[match[1]]; !ok {
+				issue("output references an unknown job", "output %q references unknown job %q", name, match[1])
+			}
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Reason < issues[j].Reason })
+	return issues
+}
+
+// callInputs are the values of a reusable workflow's inputs, from the caller or defaults.
+func callInputs(call WorkflowCall, with map[string]string) map[string]string {
+	inputs := make(map[string]string, len(call.Inputs))
+	for name, input := range call.Inputs {
+		v, ok := with[name]
+		switch {
+		case ok:
+		case input.Default != "":
+			v = input.Default
+		case input.Type == "boolean":
+			v = "false"
+		case input.Type == "number":
+			v = "0"
+		}
+		inputs[name] = v
+	}
+	return inputs
+}
+
+// resolveContexts returns a copy of m with `${{ <name>.key }}` expressions replaced.
+func resolveContexts(m map[string]string, name string, values map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	resolved := make(map[string]string, len(m))
+	for k, v := range m {
+		resolved[k] = resolveContext(v, name, values)
+	}
+	return resolved
+}
+
+// withContext returns a copy of the job with `${{ <name>.key }}` expressions replaced.
+func (j *Job) withContext(name string, values map[string]string) *Job {
+	resolve := func(m map[string]string) map[string]string {
+		return resolveContexts(m, name, values)
+	}
+
+	job := *j
+	job.Env = resolve(j.Env)
+	job.With = resolve(j.With)
+	job.Secrets.Values = resolve(j.Secrets.Values)
+	job.TimeoutMinutes = resolveContext(j.TimeoutMinutes, name, values)
+	job.ContinueOnError = resolveContext(j.ContinueOnError, name, values)
+	if j.Concurrency != nil {
+		job.Concurrency = &Concurrency{
+			Group:            resolveContext(j.Concurrency.Group, name, values),
+			CancelInProgress: j.Concurrency.CancelInProgress,
+		}
+	}
+	job.Steps = make([]Step, len(j.Steps))
+	for i, step := range j.Steps {
+		step.With = resolve(step.With)
+		step.Env = resolve(step.Env)
+		step.TimeoutMinutes = resolveContext(step.TimeoutMinutes, name, values)
+		step.ContinueOnError = resolveContext(step.ContinueOnError, name, values)
+		job.Steps[i] = step
+	}
+	return &job
+}
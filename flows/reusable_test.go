@@ -0,0 +1,320 @@
+package flows_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+	"gopkg.in/yaml.v2"
+)
+
+const reusableWorkflow = `
+on:
+  workflow_call:
+    inputs:
+      id:
+        required: true
+        type: string
+      greeting:
+        type: string
+        default: hi
+      verbose:
+        type: boolean
+    secrets:
+      token:
+        required: true
+    outputs:
+      reply:
+        value: ${{ jobs.echo.outputs.reply }}
+env:
+  WORKFLOW: reusable
+jobs:
+  echo:
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ inputs.id }}
+          token: ${{ secrets.token }}
+        env:
+          GREETING: ${{ inputs.greeting }}
+`
+
+func writeWorkflows(t *testing.T, workflows map[string]string) string {
+	dir, err := ioutil.TempDir("", "fsb-reusable")
+	require.NoError(t, err)
+	workflowsDir := filepath.Join(dir, ".github", "workflows")
+	require.NoError(t, os.MkdirAll(workflowsDir, 0755))
+	for fn, content := range workflows {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(workflowsDir, fn), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestWorkflow_Call(t *testing.T) {
+	cases := map[string]bool{
+		"on: workflow_call":           true,
+		"on: [push, workflow_call]":   true,
+		"on: push":                    false,
+		"on: {push: {}}":              false,
+		"on: {workflow_call: {}}":     true,
+		"on: {workflow_call: null}":   true,
+		"on: [push, pull_request]":    false,
+		"on: {issues: {types: [a]}} ": false,
+	}
+	for on, reusable := range cases {
+		t.Run(on, func(t *testing.T) {
+			var wf flows.Workflow
+			require.NoError(t, yaml.Unmarshal([]byte(on), &wf))
+			_, ok, err := wf.Call()
+			require.NoError(t, err)
+			assert.Equal(t, reusable, ok)
+		})
+	}
+
+	var wf flows.Workflow
+	require.NoError(t, yaml.Unmarshal([]byte(reusableWorkflow), &wf))
+	call, ok, err := wf.Call()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, flows.WorkflowCallInput{Type: "string", Default: "hi"}, call.Inputs["greeting"])
+	assert.True(t, call.Secrets["token"].Required)
+	assert.Equal(t, "${{ jobs.echo.outputs.reply }}", call.Outputs["reply"].Value)
+}
+
+func TestLoader_LoadSource_Reusable(t *testing.T) {
+	dir := writeWorkflows(t, map[string]string{
+		"echo.yml": reusableWorkflow,
+		"caller.yml": `
+on: push
+env:
+  CALLER: not passed
+jobs:
+  call:
+    uses: ./.github/workflows/echo.yml
+    with:
+      id: Cloud
+    secrets:
+      token: ${{ secrets.GITHUB_TOKEN }}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+	require.NoError(t, err)
+	loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	// The reusable workflow is only converted and reported as part of its caller:
+	require.Len(t, reports, 1)
+	assert.Equal(t, "caller.yml", reports[0].Workflow)
+
+	require.Len(t, loaded, 1)
+	assert.Equal(t, "caller.yml", loaded[0].Name)
+	require.Len(t, loaded[0].Jobs, 1)
+	assert.Equal(t, "call/echo", loaded[0].Jobs[0].Name)
+	steps := loaded[0].Steps()
+	require.Len(t, steps, 1)
+	assert.Equal(t, "call/echo-0", steps[0].Name)
+	assert.Equal(t, map[string]string{"id": "Cloud", "token": "${{ secrets.GITHUB_TOKEN }}"}, steps[0].Inputs)
+	assert.Equal(t, map[string]string{"WORKFLOW": "reusable", "GREETING": "hi"}, steps[0].Env)
+}
+
+func TestLoader_LoadSource_ReusableEnv(t *testing.T) {
+	dir := writeWorkflows(t, map[string]string{
+		"echo.yml": `
+on:
+  workflow_call:
+    inputs:
+      id:
+        type: string
+    secrets:
+      token:
+        required: true
+env:
+  SITE: site-${{ inputs.id }}
+  TOKEN: ${{ secrets.token }}
+jobs:
+  echo:
+    steps:
+      - uses: thepwagner/echo-timer@master
+        with:
+          id: ${{ inputs.id }}
+`,
+		"caller.yml": `
+on: push
+jobs:
+  call:
+    uses: ./.github/workflows/echo.yml
+    with:
+      id: Cloud
+    secrets:
+      token: ${{ secrets.GITHUB_TOKEN }}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+	require.NoError(t, err)
+	loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Empty(t, reports[0].Blockers)
+	require.Len(t, loaded, 1)
+	steps := loaded[0].Steps()
+	require.Len(t, steps, 1)
+	// The called workflow's env is resolved like its jobs:
+	assert.Equal(t, map[string]string{"SITE": "site-Cloud", "TOKEN": "${{ secrets.GITHUB_TOKEN }}"}, steps[0].Env)
+}
+
+func TestLoader_LoadSource_ReusableTimeouts(t *testing.T) {
+	called := `
+on:
+  workflow_call:
+    inputs:
+      timeout:
+        type: number
+        default: 5
+jobs:
+  echo:
+    timeout-minutes: ${{ inputs.timeout }}
+    steps:
+      - uses: thepwagner/echo-timer@master
+        timeout-minutes: ${{ inputs.timeout }}
+        with:
+          id: Cloud
+`
+	dir := writeWorkflows(t, map[string]string{
+		"echo.yml": called,
+		"caller.yml": `
+on: push
+jobs:
+  call:
+    uses: ./.github/workflows/echo.yml
+    with:
+      timeout: 2
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+	require.NoError(t, err)
+	loaded, _, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	instance := loaded[0].Jobs[0].Instances[0]
+	assert.Equal(t, 2.0, instance.TimeoutMinutes)
+	assert.Equal(t, 2.0, instance.Steps[0].TimeoutMinutes)
+
+	// The called workflow's own concurrency group can't be honored:
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".github", "workflows", "echo.yml"), []byte(called+"concurrency: echo\n"), 0644))
+	loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+	require.Len(t, reports, 1)
+	assert.Equal(t, []flows.Issue{{Step: "call", Kind: "concurrency of reusable workflows is not supported", Reason: "concurrency of reusable workflows is not supported"}}, reports[0].Blockers)
+}
+
+func TestLoader_LoadSource_ReusableInvalid(t *testing.T) {
+	cases := map[string]struct {
+		job      string
+		blockers []string
+	}{
+		"missing input and secret": {
+			job: `uses: ./.github/workflows/echo.yml`,
+			blockers: []string{
+				`missing required input "id"`,
+				`missing required secret "token"`,
+			},
+		},
+		"unknown input, bad type": {
+			job: `
+    uses: ./.github/workflows/echo.yml
+    with:
+      id: Cloud
+      verbose: yes please
+      color: blue
+    secrets: inherit`,
+			blockers: []string{
+				`input "verbose" is not a boolean: "yes please"`,
+				`reusable workflow has no input "color"`,
+			},
+		},
+		"not reusable": {
+			job:      `uses: ./.github/workflows/other.yml`,
+			blockers: []string{"./.github/workflows/other.yml is not a reusable workflow"},
+		},
+		"matrix": {
+			job: `
+    uses: ./.github/workflows/echo.yml
+    strategy:
+      matrix:
+        id: [a, b]`,
+			blockers: []string{"matrix calls of reusable workflows are not supported"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := writeWorkflows(t, map[string]string{
+				"echo.yml":  reusableWorkflow,
+				"other.yml": "on: push\n",
+				"caller.yml": `
+on: push
+jobs:
+  call:
+    ` + tc.job + "\n",
+			})
+			defer os.RemoveAll(dir)
+
+			l, err := flows.NewLoader(flows.WithActionSource(newFakeActionSource()))
+			require.NoError(t, err)
+			loaded, reports, err := l.LoadSource(context.Background(), flows.NewDirSource(dir))
+			require.NoError(t, err)
+			for _, flow := range loaded {
+				assert.NotEqual(t, "caller.yml", flow.Name)
+			}
+			var blockers []string
+			for _, r := range reports {
+				if r.Workflow == "caller.yml" {
+					for _, b := range r.Blockers {
+						assert.Equal(t, "call", b.Step)
+						blockers = append(blockers, b.Reason)
+					}
+				}
+			}
+			assert.Equal(t, tc.blockers, blockers)
+		})
+	}
+}
+
+func TestLoader_Load_RemoteReusable(t *testing.T) {
+	srv, _ := newFakeGitHub(t)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	lock := flows.NewLockfile()
+	l, err := flows.NewLoader(flows.WithHTTPClient(client), flows.WithToken(fakeToken), flows.WithLockfile(lock))
+	require.NoError(t, err)
+	loaded, reports, err := l.Load(context.Background(), "thepwagner", "reusing")
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Empty(t, reports[0].Blockers)
+	require.Len(t, loaded, 1)
+	steps := loaded[0].Steps()
+	require.Len(t, steps, 1)
+	assert.Equal(t, "call/echo-0", steps[0].Name)
+	assert.Equal(t, "Cloud", steps[0].Inputs["id"])
+
+	// The called workflow is pinned like an action:
+	const uses = "thepwagner/workflows/.github/workflows/echo.yml@main"
+	if assert.Contains(t, lock.Actions, uses) {
+		assert.Equal(t, echoTimerSHA, lock.Actions[uses].SHA)
+		assert.NotEmpty(t, lock.Actions[uses].Hash)
+	}
+}
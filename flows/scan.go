@@ -0,0 +1,168 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-github/v30/github"
+	"github.com/sirupsen/logrus"
+)
+
+// RepoFilter selects the repositories of an organization to scan.
+type RepoFilter struct {
+	// Topics, if not empty, must all be present on the repository.
+	Topics []string
+	// Visibility is one of "public", "private" or "internal"; all repositories if empty.
+	Visibility string
+	// IncludeArchived scans archived repositories.
+	IncludeArchived bool
+}
+
+func (f RepoFilter) matches(repo *github.Repository) bool {
+	if repo.GetArchived() && !f.IncludeArchived {
+		return false
+	}
+	switch f.Visibility {
+	case "public":
+		if repo.GetPrivate() {
+			return false
+		}
+	case "private":
+		if !repo.GetPrivate() {
+			return false
+		}
+	}
+	for _, topic := range f.Topics {
+		var found bool
+		for _, t := range repo.Topics {
+			if t == topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// OrgReport is the compatibility of every workflow in an organization.
+type OrgReport struct {
+	Org   string
+	Repos []RepoReport
+}
+
+// RepoReport is the compatibility of a repository's workflows.
+type RepoReport struct {
+	Repo      string
+	Workflows []Report
+	// Error, if the repository could not be loaded.
+	Error string `json:",omitempty"`
+}
+
+// OrgSummary aggregates an OrgReport, to guide migration.
+type OrgSummary struct {
+	Repos                int
+	Workflows            int
+	CompatibleWorkflows  int
+	Steps                int
+	CompatibleSteps      int
+	TopBlockers          []Count
+	TopCompatibleActions []Count
+}
+
+// Count is a number of occurrences of a name.
+type Count struct {
+	Name  string
+	Count int
+}
+
+// LoadOrg scans every repository of an organization that matches the filter.
+// Repositories and workflows that fail to load are recorded in the report instead of failing the scan.
+func (l *Loader) LoadOrg(ctx context.Context, org string, filter RepoFilter) (*OrgReport, error) {
+	logger := logrus.WithField("org", org)
+	opts := &github.RepositoryListByOrgOptions{
+		Type:        filter.Visibility,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var repos []*github.Repository
+	for {
+		page, resp, err := l.gh.Repositories.ListByOrg(ctx, org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("listing repositories: %w", err)
+		}
+		for _, repo := range page {
+			if filter.matches(repo) {
+				repos = append(repos, repo)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	logger.WithField("repos", len(repos)).Info("Listed repositories")
+
+	report := &OrgReport{Org: org}
+	for _, repo := range repos {
+		repoReport := RepoReport{Repo: repo.GetFullName()}
+		_, workflows, err := l.loadSource(ctx, l.repoSource(org, repo.GetName()), true)
+		if isNotFound(err) {
+			// No workflows directory
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logger.WithError(err).WithField("repo", repo.GetName()).Warn("Loading repository")
+			repoReport.Error = err.Error()
+		}
+		repoReport.Workflows = workflows
+		report.Repos = append(report.Repos, repoReport)
+	}
+	return report, nil
+}
+
+// Summary aggregates the report, listing up to top blockers and actions.
+func (r *OrgReport) Summary(top int) OrgSummary {
+	s := OrgSummary{Repos: len(r.Repos)}
+	blockers := map[string]int{}
+	actions := map[string]int{}
+	for _, repo := range r.Repos {
+		for _, wf := range repo.Workflows {
+			s.Workflows++
+			if wf.Compatible() {
+				s.CompatibleWorkflows++
+			}
+			s.Steps += wf.Steps
+			s.CompatibleSteps += wf.CompatibleSteps
+			for _, b := range wf.Blockers {
+				blockers[b.Kind]++
+			}
+			for _, a := range wf.Actions {
+				actions[a]++
+			}
+		}
+	}
+	s.TopBlockers = topCounts(blockers, top)
+	s.TopCompatibleActions = topCounts(actions, top)
+	return s
+}
+
+func topCounts(counts map[string]int, top int) []Count {
+	sorted := make([]Count, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, Count{Name: name, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
@@ -0,0 +1,101 @@
+package flows_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+func TestLoader_LoadOrg(t *testing.T) {
+	srv, _ := newFakeGitHub(t)
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	l, err := flows.NewLoader(flows.WithHTTPClient(client), flows.WithToken(fakeToken))
+	require.NoError(t, err)
+	report, err := l.LoadOrg(context.Background(), "thepwagner", flows.RepoFilter{Topics: []string{"fsb"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, "thepwagner", report.Org)
+	if assert.Len(t, report.Repos, 3) {
+		assert.Equal(t, "thepwagner/echo-chamber", report.Repos[0].Repo)
+		assert.Len(t, report.Repos[0].Workflows, 1)
+		assert.Equal(t, "thepwagner/no-workflows", report.Repos[1].Repo)
+		assert.Empty(t, report.Repos[1].Workflows)
+		assert.Empty(t, report.Repos[1].Error)
+
+		// A workflow that fails to load is a blocker, the others are still reported:
+		broken := report.Repos[2]
+		assert.Equal(t, "thepwagner/half-broken", broken.Repo)
+		assert.Empty(t, broken.Error)
+		if assert.Len(t, broken.Workflows, 2) {
+			assert.Equal(t, "broken.yml", broken.Workflows[0].Workflow)
+			if assert.Len(t, broken.Workflows[0].Blockers, 1) {
+				assert.Equal(t, "workflow could not be loaded", broken.Workflows[0].Blockers[0].Kind)
+				assert.Contains(t, broken.Workflows[0].Blockers[0].Reason, "decoding workflow")
+			}
+			assert.True(t, broken.Workflows[1].Compatible())
+		}
+	}
+
+	require.NoError(t, l.AddRunHistory(context.Background(), report, 10))
+	if assert.NotNil(t, report.Repos[0].Workflows[0].History) {
+		assert.Equal(t, 2, report.Repos[0].Workflows[0].History.Runs)
+	}
+
+	summary := report.Summary(5)
+	assert.Equal(t, 3, summary.Repos)
+	assert.Equal(t, 3, summary.Workflows)
+	assert.Equal(t, 2, summary.CompatibleWorkflows)
+	assert.Equal(t, []flows.Count{{Name: "workflow could not be loaded", Count: 1}}, summary.TopBlockers)
+	assert.Equal(t, []flows.Count{{Name: "thepwagner/echo-timer", Count: 2}}, summary.TopCompatibleActions)
+}
+
+func TestOrgReport_Summary(t *testing.T) {
+	report := flows.OrgReport{
+		Repos: []flows.RepoReport{
+			{
+				Repo: "org/a",
+				Workflows: []flows.Report{
+					{Workflow: "ok.yml", Steps: 2, CompatibleSteps: 2, Actions: []string{"actions/labeler", "actions/github-script"}},
+					{
+						Workflow:        "ci.yml",
+						Steps:           3,
+						CompatibleSteps: 1,
+						Actions:         []string{"actions/labeler"},
+						Blockers: []flows.Issue{
+							{Step: "build-0", Kind: "timeout-minutes is not static", Reason: `timeout-minutes "${{ inputs.a }}" is not static`},
+							{Step: "build-1", Kind: "uses interpolation", Reason: "uses interpolation"},
+						},
+					},
+				},
+			},
+			{
+				Repo: "org/b",
+				Workflows: []flows.Report{
+					{Workflow: "ci.yml", Steps: 1, Blockers: []flows.Issue{{Step: "build-0", Kind: "timeout-minutes is not static", Reason: `timeout-minutes "${{ inputs.b }}" is not static`}}},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, flows.OrgSummary{
+		Repos:               2,
+		Workflows:           3,
+		CompatibleWorkflows: 1,
+		Steps:               6,
+		CompatibleSteps:     3,
+		TopBlockers: []flows.Count{
+			{Name: "timeout-minutes is not static", Count: 2},
+		},
+		TopCompatibleActions: []flows.Count{
+			{Name: "actions/labeler", Count: 2},
+		},
+	}, report.Summary(1))
+}
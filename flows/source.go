@@ -0,0 +1,247 @@
+package flows
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v30/github"
+)
+
+// WorkflowSource provides the workflow files of a repository.
+type WorkflowSource interface {
+	Workflows(ctx context.Context) ([]WorkflowFile, error)
+}
+
+// WorkflowFile is a workflow's YAML, by path within the repository.
+type WorkflowFile struct {
+	Path    string
+	Content []byte
+}
+
+// isWorkflowFile returns true if the path is a workflow, directly within the workflows directory.
+func isWorkflowFile(p string) bool {
+	if path.Dir(p) != actionsPath {
+		return false
+	}
+	switch path.Ext(p) {
+	case ".yml", ".yaml":
+		return true
+	}
+	return false
+}
+
+// gitHubSource reads workflows through the GitHub contents API.
+type gitHubSource struct {
+	gh    *github.Client
+	owner string
+	name  string
+}
+
+func (s *gitHubSource) String() string {
+	return fmt.Sprintf("%s/%s", s.owner, s.name)
+}
+
+func (s *gitHubSource) Workflows(ctx context.Context) ([]WorkflowFile, error) {
+	paths, err := s.workflowPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]WorkflowFile, 0, len(paths))
+	for _, p := range paths {
+		content, err := s.readWorkflow(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, WorkflowFile{Path: p, Content: content})
+	}
+	return files, nil
+}
+
+// lazySource lists workflows without their content, so the loader can fetch them in parallel.
+type lazySource interface {
+	WorkflowSource
+	workflowPaths(ctx context.Context) ([]string, error)
+	readWorkflow(ctx context.Context, path string) ([]byte, error)
+}
+
+func (s *gitHubSource) workflowPaths(ctx context.Context) ([]string, error) {
+	_, listing, _, err := s.gh.Repositories.GetContents(ctx, s.owner, s.name, actionsPath, &github.RepositoryContentGetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fetching workflows: %w", err)
+	}
+	var paths []string
+	for _, wf := range listing {
+		if isWorkflowFile(wf.GetPath()) {
+			paths = append(paths, wf.GetPath())
+		}
+	}
+	return paths, nil
+}
+
+func (s *gitHubSource) readWorkflow(ctx context.Context, p string) ([]byte, error) {
+	content, _, _, err := s.gh.Repositories.GetContents(ctx, s.owner, s.name, p, &github.RepositoryContentGetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fetching workflow %q: %w", p, err)
+	}
+	decoded, err := content.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("decoding workflow %q: %w", p, err)
+	}
+	return []byte(decoded), nil
+}
+
+type dirSource struct {
+	dir string
+}
+
+// NewDirSource reads workflows from a local checkout.
+func NewDirSource(dir string) WorkflowSource {
+	return &dirSource{dir: dir}
+}
+
+func (s *dirSource) String() string {
+	return s.dir
+}
+
+func (s *dirSource) Workflows(context.Context) ([]WorkflowFile, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, filepath.FromSlash(actionsPath)))
+	if err != nil {
+		return nil, fmt.Errorf("listing workflows: %w", err)
+	}
+
+	var files []WorkflowFile
+	for _, entry := range entries {
+		p := path.Join(actionsPath, entry.Name())
+		if entry.IsDir() || !isWorkflowFile(p) {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, fmt.Errorf("reading workflow %q: %w", p, err)
+		}
+		files = append(files, WorkflowFile{Path: p, Content: content})
+	}
+	return files, nil
+}
+
+type gitSource struct {
+	gitDir string
+	ref    string
+}
+
+// NewGitSource reads workflows from a git repository (e.g. a bare clone) at a given ref.
+func NewGitSource(gitDir, ref string) WorkflowSource {
+	return &gitSource{gitDir: gitDir, ref: ref}
+}
+
+func (s *gitSource) String() string {
+	return fmt.Sprintf("%s@%s", s.gitDir, s.ref)
+}
+
+func (s *gitSource) Workflows(ctx context.Context) ([]WorkflowFile, error) {
+	// git would parse the ref as an option:
+	if strings.HasPrefix(s.ref, "-") {
+		return nil, fmt.Errorf("invalid ref %q", s.ref)
+	}
+	listing, err := s.git(ctx, "ls-tree", "--name-only", s.ref, actionsPath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("listing workflows: %w", err)
+	}
+
+	var files []WorkflowFile
+	for _, p := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+		if !isWorkflowFile(p) {
+			continue
+		}
+		content, err := s.git(ctx, "show", fmt.Sprintf("%s:%s", s.ref, p))
+		if err != nil {
+			return nil, fmt.Errorf("reading workflow %q: %w", p, err)
+		}
+		files = append(files, WorkflowFile{Path: p, Content: content})
+	}
+	return files, nil
+}
+
+func (s *gitSource) git(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", s.gitDir}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+type tarballSource struct {
+	path string
+}
+
+// NewTarballSource reads workflows from a (optionally gzipped) tarball of a repository.
+// A single top-level directory, like GitHub's archives, is tolerated.
+func NewTarballSource(path string) WorkflowSource {
+	return &tarballSource{path: path}
+}
+
+func (s *tarballSource) String() string {
+	return s.path
+}
+
+func (s *tarballSource) Workflows(context.Context) ([]WorkflowFile, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("opening tarball: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(s.path, ".gz") || strings.HasSuffix(s.path, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing tarball: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var files []WorkflowFile
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading tarball: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		p := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if !isWorkflowFile(p) {
+			// Strip the archive's top-level directory:
+			if i := strings.Index(p, "/"); i >= 0 {
+				p = p[i+1:]
+			}
+			if !isWorkflowFile(p) {
+				continue
+			}
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading workflow %q: %w", p, err)
+		}
+		files = append(files, WorkflowFile{Path: p, Content: content})
+	}
+	return files, nil
+}
@@ -0,0 +1,114 @@
+package flows_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/func-soul-brother/flows"
+)
+
+const dockerWorkflow = `
+on: push
+jobs:
+  hello:
+    steps:
+      - uses: docker://alpine:3
+`
+
+var testRepoFiles = map[string]string{
+	".github/workflows/docker.yml":   dockerWorkflow,
+	".github/workflows/other.yaml":   "on: push\n",
+	".github/workflows/README.md":    "not a workflow",
+	".github/workflows/nested/x.yml": "on: push\n",
+	"README.md":                      "# test",
+}
+
+func writeTestRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fsb-source")
+	require.NoError(t, err)
+	for p, content := range testRepoFiles {
+		fn := filepath.Join(dir, filepath.FromSlash(p))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fn), 0755))
+		require.NoError(t, ioutil.WriteFile(fn, []byte(content), 0644))
+	}
+	return dir
+}
+
+func assertTestWorkflows(t *testing.T, src flows.WorkflowSource) {
+	files, err := src.Workflows(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []flows.WorkflowFile{
+		{Path: ".github/workflows/docker.yml", Content: []byte(dockerWorkflow)},
+		{Path: ".github/workflows/other.yaml", Content: []byte("on: push\n")},
+	}, files)
+}
+
+func TestDirSource(t *testing.T) {
+	dir := writeTestRepo(t)
+	defer os.RemoveAll(dir)
+
+	assertTestWorkflows(t, flows.NewDirSource(dir))
+}
+
+func TestGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := writeTestRepo(t)
+	defer os.RemoveAll(dir)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "test"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	// Changes after the ref are ignored:
+	require.NoError(t, os.Remove(filepath.Join(dir, ".github", "workflows", "other.yaml")))
+
+	assertTestWorkflows(t, flows.NewGitSource(filepath.Join(dir, ".git"), "v1"))
+
+	out := filepath.Join(dir, "out")
+	_, err := flows.NewGitSource(filepath.Join(dir, ".git"), "--output="+out).Workflows(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("invalid ref %q", "--output="+out))
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTarballSource(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsb-source-*.tar.gz")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for p, content := range testRepoFiles {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     "echo-chamber-0123456/" + p,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+
+	assertTestWorkflows(t, flows.NewTarballSource(f.Name()))
+}
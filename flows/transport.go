@@ -0,0 +1,299 @@
+package flows
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIBudget summarizes the GitHub API usage of a Loader.
+type APIBudget struct {
+	// Requests sent, including conditional requests.
+	Requests int
+	// NotModified conditional requests, served from the HTTP cache.
+	NotModified int
+	// Retries after hitting a rate limit.
+	Retries int
+	// Remaining and Limit as last reported by the API.
+	Remaining int
+	Limit     int
+	Reset     time.Time
+}
+
+// rateLimitTransport honors GitHub's `X-RateLimit-*` headers and secondary rate limits,
+// waiting for the limit to reset instead of failing.
+type rateLimitTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	// sleep waits, unless the context is done. Replaced in tests.
+	sleep func(context.Context, time.Duration) error
+	now   func() time.Time
+
+	mu     sync.Mutex
+	budget APIBudget
+	// blockedUntil holds back requests once the budget is spent, or a rate limit asked for a delay.
+	blockedUntil time.Time
+}
+
+// secondaryRateLimitWait is GitHub's advice for secondary rate limits without `Retry-After`.
+const secondaryRateLimitWait = time.Minute
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{
+		base:       base,
+		maxRetries: 3,
+		sleep:      sleepContext,
+		now:        time.Now,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *rateLimitTransport) Budget() APIBudget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.budget
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only requests without a body can be replayed:
+	retryable := req.Body == nil || req.Body == http.NoBody
+	for attempt := 0; ; attempt++ {
+		if err := t.waitUntilUnblocked(req); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		// Usable responses are returned even if they spent the budget, the next request waits instead:
+		if !t.observe(resp) || !retryable || attempt >= t.maxRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+		t.mu.Lock()
+		t.budget.Retries++
+		t.mu.Unlock()
+	}
+}
+
+func (t *rateLimitTransport) waitUntilUnblocked(req *http.Request) error {
+	t.mu.Lock()
+	wait := t.blockedUntil.Sub(t.now())
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"url":  req.URL.String(),
+		"wait": wait,
+	}).Warn("GitHub API rate limited, waiting")
+	return t.sleep(req.Context(), wait)
+}
+
+// observe records the response in the budget, blocking further requests if needed.
+// Returns true if the response was rate limited, and should be retried.
+func (t *rateLimitTransport) observe(resp *http.Response) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.budget.Requests++
+	if resp.StatusCode == http.StatusNotModified {
+		t.budget.NotModified++
+	}
+
+	remaining, hasRemaining := headerInt(resp.Header, "X-RateLimit-Remaining")
+	if hasRemaining {
+		t.budget.Remaining = remaining
+	}
+	if limit, ok := headerInt(resp.Header, "X-RateLimit-Limit"); ok {
+		t.budget.Limit = limit
+	}
+	if reset, ok := headerInt(resp.Header, "X-RateLimit-Reset"); ok {
+		t.budget.Reset = time.Unix(int64(reset), 0)
+	}
+
+	now := t.now()
+	block := func(wait time.Duration) {
+		if until := now.Add(wait); until.After(t.blockedUntil) {
+			t.blockedUntil = until
+		}
+	}
+	limited := resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests
+	switch {
+	case limited && hasRemaining && remaining == 0:
+		// The primary rate limit, which may have reset since:
+		if wait := t.budget.Reset.Sub(now); wait > 0 {
+			block(wait)
+		} else {
+			block(time.Second)
+		}
+		return true
+	case limited && resp.Header.Get("Retry-After") != "":
+		retryAfter, _ := headerInt(resp.Header, "Retry-After")
+		block(time.Duration(retryAfter) * time.Second)
+		return true
+	case limited && (resp.StatusCode == http.StatusTooManyRequests || isSecondaryRateLimit(resp)):
+		block(secondaryRateLimitWait)
+		return true
+	case hasRemaining && remaining == 0:
+		block(t.budget.Reset.Sub(now))
+	}
+	return false
+}
+
+// isSecondaryRateLimit tells secondary rate limits from other forbidden responses by their message.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	message := strings.ToLower(string(body))
+	return strings.Contains(message, "secondary rate limit") || strings.Contains(message, "abuse detection")
+}
+
+func headerInt(h http.Header, key string) (int, bool) {
+	v := h.Get(key)
+	if v == "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(v)
+	return i, err == nil
+}
+
+// httpCacheTransport makes conditional requests with `If-None-Match`, persisting responses to a directory.
+// Not modified responses do not count against GitHub's rate limit.
+type httpCacheTransport struct {
+	base http.RoundTripper
+	dir  string
+}
+
+type cachedResponse struct {
+	ETag       string      `json:"etag"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+func newHTTPCacheTransport(base http.RoundTripper, dir string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &httpCacheTransport{base: base, dir: dir}
+}
+
+func (t *httpCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	// Responses vary by credentials, they are part of the key:
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", req.URL.String(), req.Header.Get("Accept"), req.Header.Get("Authorization"))))
+	fn := filepath.Join(t.dir, hex.EncodeToString(key[:])+".json")
+	cached := readCachedResponse(fn)
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		header := cached.Header.Clone()
+		// Keep the fresh rate limit headers:
+		for k, v := range resp.Header {
+			header[k] = v
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", cached.StatusCode, http.StatusText(cached.StatusCode)),
+			StatusCode:    cached.StatusCode,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := writeCachedResponse(fn, cachedResponse{ETag: etag, StatusCode: resp.StatusCode, Header: resp.Header, Body: body}); err != nil {
+		logrus.WithError(err).Warn("Caching HTTP response")
+	}
+	return resp, nil
+}
+
+func readCachedResponse(fn string) *cachedResponse {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(b, &cached); err != nil || cached.ETag == "" {
+		return nil
+	}
+	return &cached
+}
+
+func writeCachedResponse(fn string, cached cachedResponse) error {
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
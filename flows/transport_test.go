@@ -0,0 +1,198 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRateLimitTransport(now time.Time) (*rateLimitTransport, *[]time.Duration) {
+	var slept []time.Duration
+	t := newRateLimitTransport(nil)
+	t.now = func() time.Time { return now }
+	t.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return t, &slept
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	reset := now.Add(time.Minute)
+
+	cases := map[string]struct {
+		responses []func(http.ResponseWriter)
+		slept     []time.Duration
+		retries   int
+	}{
+		"ok": {
+			responses: []func(http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.Header().Set("X-RateLimit-Remaining", "10")
+				},
+			},
+		},
+		"primary limit": {
+			responses: []func(http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.Header().Set("X-RateLimit-Remaining", "0")
+					w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+					w.WriteHeader(http.StatusForbidden)
+				},
+				func(w http.ResponseWriter) {
+					w.Header().Set("X-RateLimit-Remaining", "4999")
+				},
+			},
+			slept:   []time.Duration{time.Minute},
+			retries: 1,
+		},
+		"secondary limit": {
+			responses: []func(http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.Header().Set("Retry-After", "5")
+					w.WriteHeader(http.StatusForbidden)
+				},
+				func(w http.ResponseWriter) {},
+			},
+			slept:   []time.Duration{5 * time.Second},
+			retries: 1,
+		},
+		"secondary limit without retry-after": {
+			responses: []func(http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.WriteHeader(http.StatusForbidden)
+					_, _ = fmt.Fprint(w, `{"message":"You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`)
+				},
+				func(w http.ResponseWriter) {},
+			},
+			slept:   []time.Duration{time.Minute},
+			retries: 1,
+		},
+		"last request": {
+			// Returned without waiting, the next request waits:
+			responses: []func(http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.Header().Set("X-RateLimit-Remaining", "0")
+					w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.responses[calls](w)
+				calls++
+			}))
+			defer srv.Close()
+
+			transport, slept := newTestRateLimitTransport(now)
+			resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, len(tc.responses), calls)
+			assert.Equal(t, tc.slept, *slept)
+			budget := transport.Budget()
+			assert.Equal(t, len(tc.responses), budget.Requests)
+			assert.Equal(t, tc.retries, budget.Retries)
+		})
+	}
+}
+
+func TestRateLimitTransport_Blocked(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(now.Add(time.Hour).Unix()))
+	}))
+	defer srv.Close()
+	transport, slept := newTestRateLimitTransport(now)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, *slept)
+
+	resp, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []time.Duration{time.Hour}, *slept)
+	assert.Equal(t, 2, calls)
+
+	// Other forbidden responses are not retried:
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprint(w, `{"message":"Resource not accessible by integration"}`)
+	}))
+	defer forbidden.Close()
+	transport, slept = newTestRateLimitTransport(now)
+	resp, err = (&http.Client{Transport: transport}).Get(forbidden.URL)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, string(body), "Resource not accessible")
+	assert.Empty(t, *slept)
+}
+
+func TestHTTPCacheTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsb-http-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + r.Header.Get("Authorization") + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = fmt.Fprintf(w, "hello %s", r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	rateLimit, _ := newTestRateLimitTransport(time.Now())
+	client := &http.Client{Transport: newHTTPCacheTransport(rateLimit, dir)}
+	get := func(auth string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	assert.Equal(t, "hello alice", get("alice"))
+	assert.Equal(t, "hello alice", get("alice"))
+	assert.Equal(t, 1, conditional)
+	// Cached responses are not shared between credentials:
+	assert.Equal(t, "hello bob", get("bob"))
+	assert.Equal(t, 1, conditional)
+
+	budget := rateLimit.Budget()
+	assert.Equal(t, 3, budget.Requests)
+	assert.Equal(t, 1, budget.NotModified)
+}
@@ -2,47 +2,475 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/thepwagner/func-soul-brother/az"
 	"github.com/thepwagner/func-soul-brother/flows"
 )
 
+// Target repository to convert:
+const (
+	owner           = "thepwagner"
+	name            = "echo-chamber"
+	azResourceGroup = "funcsoulbrother"
+)
+
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	// Target repository to convert:
-	const (
-		owner           = "thepwagner"
-		name            = "echo-chamber"
-		azResourceGroup = "funcsoulbrother"
-	)
+	cmd, args := "deploy", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+
+	ctx := context.Background()
+	switch cmd {
+	case "deploy":
+		deploy(ctx, args)
+	case "update":
+		update(ctx, args)
+	case "vendor":
+		vendor(ctx, args)
+	case "scan":
+		scan(ctx, args)
+	case "run":
+		run(ctx, args)
+	default:
+		logrus.WithField("command", cmd).Fatal("Unknown command, expected deploy, update, vendor, scan or run")
+	}
+}
+
+// deploy converts the target repository's workflows, reusing action SHAs pinned in the lockfile.
+func deploy(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	src := registerLoadFlags(fs)
+	planName := fs.String("plan", string(az.ConsumptionPlan), "Azure Functions hosting plan, consumption or premium for workflows running over 10 minutes")
+	deliveryTTL := fs.Duration("delivery-ttl", az.DefaultDeliveryPolicy.TTL, "How long delivery IDs are remembered to skip redeliveries, 0 to disable")
+	maxDeliveryAge := fs.Duration("max-delivery-age", az.DefaultDeliveryPolicy.MaxAge, "Reject deliveries of events that happened longer ago, 0 to accept any age; only pushes and new or edited issues, pull requests, reviews and comments are timed")
+	ignoreSenders := fs.String("ignore-senders", "", "Comma separated logins whose events don't trigger workflows")
+	ignoreBots := fs.Bool("ignore-bots", false, "Events sent by bots don't trigger workflows")
+	ignoreAppID := fs.Int64("ignore-app-id", 0, "Events performed via this GitHub App don't trigger workflows, e.g. the app of GITHUB_TOKEN")
+	ignoreSelf := fs.Bool("ignore-self", false, "Events sent by the user of GITHUB_TOKEN don't trigger workflows, only for tokens of a machine user")
+	_ = fs.Parse(args)
+	plan, err := az.ParsePlan(*planName)
+	if err != nil {
+		logrus.WithError(err).Fatal("Parsing flags")
+	}
+
 	azSubscriptionID := os.Getenv("AZ_SUBSCRIPTION")
 	ghToken := os.Getenv("GITHUB_TOKEN")
-	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	webhookSecrets := az.ParseWebhookSecrets(os.Getenv("WEBHOOK_SECRET"))
+	if len(webhookSecrets) == 0 {
+		logrus.Fatal("WEBHOOK_SECRET is required, with one secret per line while rotating")
+	}
 
-	loader := flows.NewLoader(flows.WithToken(ghToken))
+	lock, err := flows.ReadLockfile(flows.LockfileName)
+	if err != nil {
+		logrus.WithError(err).Fatal("Reading lockfile")
+	}
+	loader := src.newLoader(lock)
 
 	// Query target repo for workflows
-	ctx := context.Background()
-	loaded, err := loader.Load(ctx, owner, name)
-	if err != nil {
-		logrus.WithError(err).Fatal("Loading repo workflows")
+	loaded := src.load(ctx, loader)
+	if err := lock.Write(flows.LockfileName); err != nil {
+		logrus.WithError(err).Fatal("Writing lockfile")
 	}
 	if len(loaded) == 0 {
 		logrus.Fatal("No convertible flows found")
 	}
 	logrus.WithField("flows", len(loaded)).Info("Loaded flows")
 
-	uploader, err := az.NewFunctionUploader(azSubscriptionID, azResourceGroup, webhookSecret, ghToken)
+	senders := az.SenderPolicy{
+		Logins: splitList(*ignoreSenders),
+		Bots:   *ignoreBots,
+		AppID:  *ignoreAppID,
+	}
+	if *ignoreSelf {
+		// Like GITHUB_TOKEN, events caused by the workflow's own token don't trigger it again:
+		if login, err := loader.TokenLogin(ctx); err != nil {
+			logrus.WithError(err).Warn("Events caused by GITHUB_TOKEN will trigger workflows, use -ignore-app-id for installation tokens")
+		} else {
+			senders.Logins = append(senders.Logins, login)
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"logins": senders.Logins,
+		"bots":   senders.Bots,
+		"app_id": senders.AppID,
+	}).Info("Ignoring senders")
+
+	uploader, err := az.NewFunctionUploader(azSubscriptionID, azResourceGroup, webhookSecrets, ghToken, plan, az.DeliveryPolicy{
+		TTL:     *deliveryTTL,
+		MaxAge:  *maxDeliveryAge,
+		Senders: senders,
+	})
 	if err != nil {
 		logrus.WithError(err).Fatal("Preparing function uploader")
 	}
 	for _, flow := range loaded {
 		// TODO: receive a endpoint, configure the repo webhook according to flow.Triggers
-		if err := uploader.Upload(ctx, flow); err != nil {
+		if err := uploader.Upload(ctx, flow); errors.Is(err, az.ErrTimeoutExceedsPlan) {
+			logrus.WithError(err).Error("Workflow does not fit the hosting plan, set shorter timeout-minutes or deploy with -plan premium")
+		} else if err != nil {
 			logrus.WithError(err).Error("Uploading workflow")
 		}
 	}
 }
+
+// update re-resolves every action ref of the target repository, bumping the lockfile.
+func update(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	src := registerLoadFlags(fs)
+	_ = fs.Parse(args)
+
+	lock := flows.NewLockfile()
+	src.load(ctx, src.newLoader(lock))
+	if err := lock.Write(flows.LockfileName); err != nil {
+		logrus.WithError(err).Fatal("Writing lockfile")
+	}
+	logrus.WithField("actions", len(lock.Actions)).Info("Updated lockfile")
+}
+
+// vendor populates the action cache with every action referenced by the target repository, for -offline use.
+func vendor(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("vendor", flag.ExitOnError)
+	src := registerLoadFlags(fs)
+	_ = fs.Parse(args)
+	src.offline = false
+
+	lock, err := flows.ReadLockfile(flows.LockfileName)
+	if err != nil {
+		logrus.WithError(err).Fatal("Reading lockfile")
+	}
+	src.load(ctx, src.newLoader(lock))
+	if err := lock.Write(flows.LockfileName); err != nil {
+		logrus.WithError(err).Fatal("Writing lockfile")
+	}
+	logrus.WithFields(logrus.Fields{
+		"actions": len(lock.Actions),
+		"cache":   src.cacheDir,
+	}).Info("Vendored actions")
+}
+
+// scan reports the convertible workflows of every repository in an organization.
+func scan(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	src := registerLoadFlags(fs)
+	org := fs.String("org", owner, "organization to scan")
+	topics := fs.String("topics", "", "only scan repositories with all of these topics, comma separated")
+	visibility := fs.String("visibility", "", "only scan public, private or internal repositories")
+	archived := fs.Bool("archived", false, "include archived repositories")
+	top := fs.Int("top", 10, "blockers and actions to summarize")
+	asJSON := fs.Bool("json", false, "print the full report as JSON")
+	history := fs.Int("history", 20, "recent runs of each workflow to sample for estimates, 0 to disable")
+	prices := fs.String("prices", "", "JSON price model, overriding the default consumption plan prices")
+	_ = fs.Parse(args)
+
+	priceModel := az.DefaultPriceModel
+	if *prices != "" {
+		var err error
+		if priceModel, err = az.ReadPriceModel(*prices); err != nil {
+			logrus.WithError(err).Fatal("Reading price model")
+		}
+	}
+
+	loader := src.newLoader(flows.NewLockfile())
+	report, err := loader.LoadOrg(ctx, *org, flows.RepoFilter{
+		Topics:          splitList(*topics),
+		Visibility:      *visibility,
+		IncludeArchived: *archived,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Scanning organization")
+	}
+	if *history > 0 {
+		if err := loader.AddRunHistory(ctx, report, *history); err != nil {
+			logrus.WithError(err).Fatal("Reading run history")
+		}
+	}
+	summary := report.Summary(*top)
+	estimates := map[string]az.Estimate{}
+	for _, repo := range report.Repos {
+		for _, wf := range repo.Workflows {
+			if wf.History != nil && wf.History.Runs > 0 {
+				estimates[repo.Repo+"/"+wf.Workflow] = priceModel.Estimate(wf.Steps, *wf.History)
+			}
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			*flows.OrgReport
+			Summary   flows.OrgSummary
+			Estimates map[string]az.Estimate
+		}{report, summary, estimates}); err != nil {
+			logrus.WithError(err).Fatal("Encoding report")
+		}
+		return
+	}
+
+	for _, repo := range report.Repos {
+		if repo.Error != "" {
+			fmt.Printf("%s: %s\n", repo.Repo, repo.Error)
+			continue
+		}
+		for _, wf := range repo.Workflows {
+			status := "blocked"
+			if wf.Compatible() {
+				status = "compatible"
+			}
+			fmt.Printf("%s %s: %s (%d/%d steps)\n", repo.Repo, wf.Workflow, status, wf.CompatibleSteps, wf.Steps)
+			if e, ok := estimates[repo.Repo+"/"+wf.Workflow]; ok {
+				fmt.Printf("  %.0f runs/month, %s on runners vs %s as a function (saves %s), $%.2f/month vs $%.2f/month\n",
+					e.RunsPerMonth, e.RunnerLatency, e.FunctionLatency, e.LatencySaved(), e.RunnerCost, e.FunctionCost)
+			}
+		}
+	}
+	fmt.Printf("\n%d repos, %d/%d workflows compatible, %d/%d steps compatible\n",
+		summary.Repos, summary.CompatibleWorkflows, summary.Workflows, summary.CompatibleSteps, summary.Steps)
+	fmt.Println("\nTop blockers:")
+	for _, c := range summary.TopBlockers {
+		fmt.Printf("  %4d  %s\n", c.Count, c.Name)
+	}
+	fmt.Println("\nTop compatible actions:")
+	for _, c := range summary.TopCompatibleActions {
+		fmt.Printf("  %4d  %s\n", c.Count, c.Name)
+	}
+}
+
+// run serves the target repository's converted workflows locally, running deliveries with node.
+func run(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	src := registerLoadFlags(fs)
+	addr := fs.String("addr", "localhost:7071", "address to receive webhook deliveries on")
+	forward := fs.String("forward", "", "smee.io channel URL to forward live webhook deliveries from")
+	sign := fs.Bool("sign", false, "re-sign every delivery with the local secret, for recorded payloads; -addr must be a loopback address, and -forward can not be used")
+	maxDeliveryAge := fs.Duration("max-delivery-age", 0, "Reject deliveries of events that happened longer ago, 0 to accept any age; only pushes and new or edited issues, pull requests, reviews and comments are timed")
+	ignoreSenders := fs.String("ignore-senders", "", "Comma separated logins whose events don't trigger workflows")
+	ignoreBots := fs.Bool("ignore-bots", false, "Events sent by bots don't trigger workflows")
+	_ = fs.Parse(args)
+	// Signing would let anyone who can reach the server run the workflows, including anyone who posts to a public smee channel:
+	if *sign && !isLoopback(*addr) {
+		logrus.WithField("addr", *addr).Fatal("-sign requires a loopback -addr, e.g. localhost:7071")
+	}
+	if *sign && *forward != "" {
+		logrus.Fatal("-sign can not be used with -forward, anyone can post to the smee channel")
+	}
+
+	ghToken := os.Getenv("GITHUB_TOKEN")
+	webhookSecrets := az.ParseWebhookSecrets(os.Getenv("WEBHOOK_SECRET"))
+	if len(webhookSecrets) == 0 {
+		if !*sign {
+			logrus.Fatal("WEBHOOK_SECRET is required to verify deliveries, or -sign to sign them locally")
+		}
+		webhookSecrets = []string{"local"}
+	}
+	if *forward != "" {
+		logrus.Warn("smee re-encodes payloads, their signatures may not verify")
+	}
+
+	lock, err := flows.ReadLockfile(flows.LockfileName)
+	if err != nil {
+		logrus.WithError(err).Fatal("Reading lockfile")
+	}
+	loaded := src.load(ctx, src.newLoader(lock))
+	if err := lock.Write(flows.LockfileName); err != nil {
+		logrus.WithError(err).Fatal("Writing lockfile")
+	}
+	if len(loaded) == 0 {
+		logrus.Fatal("No convertible flows found")
+	}
+
+	// Redeliveries are run again, there is no storage to remember them in:
+	policy := az.DeliveryPolicy{
+		MaxAge: *maxDeliveryAge,
+		Senders: az.SenderPolicy{
+			Logins: splitList(*ignoreSenders),
+			Bots:   *ignoreBots,
+		},
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	mux := http.NewServeMux()
+	for _, flow := range loaded {
+		emulator, err := az.NewEmulator(".", flow, webhookSecrets, ghToken, policy)
+		if err != nil {
+			logrus.WithError(err).WithField("workflow", flow.Name).Fatal("Preparing emulator")
+		}
+		defer emulator.Close()
+		emulator.Sign = *sign
+
+		path := "/" + flow.Name
+		mux.Handle(path, emulator)
+		if len(loaded) == 1 {
+			mux.Handle("/", emulator)
+		}
+		logrus.WithField("url", "http://"+*addr+path).Info("Serving workflow")
+		if *forward != "" {
+			go func(target string) {
+				_ = az.Forward(ctx, http.DefaultClient, *forward, target)
+			}("http://" + *addr + path)
+		}
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Error("Serving workflows")
+	}
+}
+
+// isLoopback returns true if addr only listens on the local machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loadFlags select where workflows are read from, defaulting to the target repository on GitHub.
+type loadFlags struct {
+	dir     string
+	gitDir  string
+	ref     string
+	tarball string
+
+	cacheDir     string
+	httpCacheDir string
+	offline      bool
+	concurrency  int
+
+	githubURL       string
+	githubUploadURL string
+	githubConnect   bool
+}
+
+func registerLoadFlags(fs *flag.FlagSet) *loadFlags {
+	var s loadFlags
+	fs.StringVar(&s.dir, "dir", "", "read workflows from a local checkout")
+	fs.StringVar(&s.gitDir, "git-dir", "", "read workflows from a git repository, at -ref")
+	fs.StringVar(&s.ref, "ref", "HEAD", "ref to read from -git-dir")
+	fs.StringVar(&s.tarball, "tarball", "", "read workflows from a repository tarball")
+	fs.StringVar(&s.cacheDir, "cache", cacheDir("actions"), "cache actions in this directory")
+	fs.StringVar(&s.httpCacheDir, "http-cache", cacheDir("http"), "cache GitHub API responses in this directory")
+	fs.BoolVar(&s.offline, "offline", false, "only use actions from the cache")
+	fs.IntVar(&s.concurrency, "concurrency", 4, "workflows and actions to load in parallel")
+	fs.StringVar(&s.githubURL, "github-url", "", "GitHub Enterprise Server URL, e.g. https://github.example.com/")
+	fs.StringVar(&s.githubUploadURL, "github-upload-url", "", "GitHub Enterprise Server upload URL, defaults to -github-url")
+	fs.BoolVar(&s.githubConnect, "github-connect", false, "resolve actions missing from GitHub Enterprise Server from github.com")
+	return &s
+}
+
+// cacheDir defaults caches to the user's cache directory, they hold private repository contents
+// and must not end up in a commit of the working directory.
+func cacheDir(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "fsb", name)
+}
+
+func (s *loadFlags) newLoader(lock *flows.Lockfile) *flows.Loader {
+	opts := []flows.Opt{
+		flows.WithToken(os.Getenv("GITHUB_TOKEN")),
+		flows.WithLockfile(lock),
+		flows.WithPolicy(actionPolicy()),
+		flows.WithActionCache(s.cacheDir, s.offline),
+		flows.WithConcurrency(s.concurrency),
+		flows.WithHTTPCache(s.httpCacheDir),
+	}
+	// Per-host credentials, e.g. FSB_HOST_TOKENS=api.github.com=abc,github.example.com=def
+	for _, hostToken := range splitList(os.Getenv("FSB_HOST_TOKENS")) {
+		if i := strings.Index(hostToken, "="); i > 0 {
+			opts = append(opts, flows.WithHostToken(hostToken[:i], hostToken[i+1:]))
+		}
+	}
+	if s.githubURL != "" {
+		opts = append(opts, flows.WithBaseURL(s.githubURL), flows.WithUploadURL(s.githubUploadURL))
+		if s.githubConnect {
+			opts = append(opts, flows.WithGitHubConnect())
+		}
+	}
+	loader, err := flows.NewLoader(opts...)
+	if err != nil {
+		logrus.WithError(err).Fatal("Preparing loader")
+	}
+	return loader
+}
+
+func (s *loadFlags) load(ctx context.Context, loader *flows.Loader) []flows.LoadedFlow {
+	var loaded []flows.LoadedFlow
+	var reports []flows.Report
+	var err error
+	switch {
+	case s.dir != "":
+		loaded, reports, err = loader.LoadSource(ctx, flows.NewDirSource(s.dir))
+	case s.gitDir != "":
+		loaded, reports, err = loader.LoadSource(ctx, flows.NewGitSource(s.gitDir, s.ref))
+	case s.tarball != "":
+		loaded, reports, err = loader.LoadSource(ctx, flows.NewTarballSource(s.tarball))
+	default:
+		loaded, reports, err = loader.Load(ctx, owner, name)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Loading repo workflows")
+	}
+	budget := loader.Budget()
+	logrus.WithFields(logrus.Fields{
+		"requests":     budget.Requests,
+		"not_modified": budget.NotModified,
+		"retries":      budget.Retries,
+		"remaining":    budget.Remaining,
+		"limit":        budget.Limit,
+	}).Info("GitHub API budget used")
+	for _, report := range reports {
+		reportLogger := logrus.WithField("workflow", report.Workflow)
+		for _, issue := range report.Blockers {
+			reportLogger.WithField("step", issue.Step).Info(issue.Reason)
+		}
+		for _, issue := range report.Warnings {
+			reportLogger.WithField("step", issue.Step).Warn(issue.Reason)
+		}
+	}
+	return loaded
+}
+
+// actionPolicy restricts deployed actions, e.g. FSB_ALLOW_OWNERS=actions,thepwagner
+func actionPolicy() flows.ActionPolicy {
+	return flows.ActionPolicy{
+		AllowOwners:     splitList(os.Getenv("FSB_ALLOW_OWNERS")),
+		DenyOwners:      splitList(os.Getenv("FSB_DENY_OWNERS")),
+		RequireVerified: os.Getenv("FSB_REQUIRE_VERIFIED") != "",
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}